@@ -0,0 +1,65 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// abiArchs maps android abi to atx-agent release arch, in fallback order
+var abiArchs = map[string][]string{
+	"arm64-v8a":   {"arm64", "armv7", "armv6"},
+	"armeabi-v7a": {"armv7", "armv6"},
+	"armeabi":     {"armv6"},
+	"x86_64":      {"amd64", "386"},
+	"x86":         {"386"},
+}
+
+const defaultAgentArch = "armv6"
+
+// deviceAbis return the abis supported by device, the most preferred first
+func deviceAbis(props map[string]string) []string {
+	abis := make([]string, 0)
+	for _, abi := range strings.Split(props["ro.product.cpu.abilist"], ",") {
+		abi = strings.TrimSpace(abi)
+		if abi != "" && !containsString(abis, abi) {
+			abis = append(abis, abi)
+		}
+	}
+	// ro.product.cpu.abilist is not available before Android 5.0
+	for _, key := range []string{"ro.product.cpu.abi", "ro.product.cpu.abi2"} {
+		if abi := props[key]; abi != "" && !containsString(abis, abi) {
+			abis = append(abis, abi)
+		}
+	}
+	return abis
+}
+
+// agentArchs return the atx-agent release archs which can run on device, in the order to try
+func agentArchs(props map[string]string) []string {
+	archs := make([]string, 0)
+	for _, abi := range deviceAbis(props) {
+		for _, arch := range abiArchs[abi] {
+			if !containsString(archs, arch) {
+				archs = append(archs, arch)
+			}
+		}
+	}
+	if len(archs) == 0 {
+		archs = append(archs, defaultAgentArch)
+	}
+	return archs
+}
+
+// allAgentArchs return every atx-agent release arch used by known abis
+func allAgentArchs() []string {
+	archs := make([]string, 0)
+	for _, as := range abiArchs {
+		for _, arch := range as {
+			if !containsString(archs, arch) {
+				archs = append(archs, arch)
+			}
+		}
+	}
+	sort.Strings(archs)
+	return archs
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAgentArchs(t *testing.T) {
+	tests := []struct {
+		props  map[string]string
+		expect []string
+	}{
+		{map[string]string{}, []string{"armv6"}},
+		{map[string]string{"ro.product.cpu.abi": "armeabi-v7a", "ro.product.cpu.abi2": "armeabi"}, []string{"armv7", "armv6"}},
+		{map[string]string{"ro.product.cpu.abilist": "arm64-v8a,armeabi-v7a,armeabi"}, []string{"arm64", "armv7", "armv6"}},
+		{map[string]string{"ro.product.cpu.abilist": "x86_64,x86,armeabi-v7a"}, []string{"amd64", "386", "armv7", "armv6"}},
+		{map[string]string{"ro.product.cpu.abi": "mips"}, []string{"armv6"}},
+	}
+	for _, tt := range tests {
+		if got := agentArchs(tt.props); !reflect.DeepEqual(got, tt.expect) {
+			t.Errorf("agentArchs(%v) expect %v, got %v", tt.props, tt.expect, got)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+)
+
+// bundle is a tar.gz, index.json first, then files in resources/
+const (
+	bundleIndexName = "index.json"
+	bundleFilesDir  = "resources/"
+)
+
+// BundleFile is a resource file in bundle
+type BundleFile struct {
+	Name      string `json:"name"` // base name in resourcesDir
+	Component string `json:"component"`
+	Version   string `json:"version"`
+	Arch      string `json:"arch,omitempty"`
+	Install   string `json:"install"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+}
+
+// BundleIndex is index.json of bundle
+type BundleIndex struct {
+	Created time.Time    `json:"created"`
+	Files   []BundleFile `json:"files"`
+}
+
+func (idx *BundleIndex) file(name string) (BundleFile, bool) {
+	for _, f := range idx.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return BundleFile{}, false
+}
+
+// exportBundle download every resource needed by manifest, and pack them into filename
+func exportBundle(filename string) (*BundleIndex, error) {
+	idx := &BundleIndex{Created: time.Now()}
+	for _, c := range manifest.Resources() {
+		if _, err := c.Fetch(); err != nil {
+			return nil, errors.Wrapf(err, "fetch %s %s %s", c.Name, c.Version, c.Arch)
+		}
+		localPath := c.LocalPath()
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := fileSHA256(localPath)
+		if err != nil {
+			return nil, err
+		}
+		idx.Files = append(idx.Files, BundleFile{
+			Name:      filepath.Base(localPath),
+			Component: c.Name,
+			Version:   c.Version,
+			Arch:      c.Arch,
+			Install:   c.Install,
+			Size:      info.Size(),
+			SHA256:    sum,
+		})
+	}
+
+	tmpName := filename + partialFileSuffix
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpName)
+	if err = writeBundle(f, idx); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return idx, os.Rename(tmpName, filename)
+}
+
+func writeBundle(w io.Writer, idx *BundleIndex) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: bundleIndexName, Mode: 0644, Size: int64(len(data)), ModTime: idx.Created}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err = tw.Write(data); err != nil {
+		return err
+	}
+	for _, bf := range idx.Files {
+		if err = writeBundleFile(tw, bf); err != nil {
+			return errors.Wrap(err, bf.Name)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func writeBundleFile(tw *tar.Writer, bf BundleFile) error {
+	f, err := os.Open(filepath.Join(resourcesDir, bf.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: bundleFilesDir + bf.Name, Mode: 0644, Size: bf.Size, ModTime: info.ModTime()}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, bf.Size)
+	return err
+}
+
+// importBundle unpack bundle into resourcesDir, every file is verified by index.json
+// Files not listed in index, or with wrong sha256 are rejected
+func importBundle(filename string) (*BundleIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "open bundle")
+	}
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "read bundle")
+	}
+	if hdr.Name != bundleIndexName {
+		return nil, fmt.Errorf("invalid bundle, expect %s first, got %s", bundleIndexName, hdr.Name)
+	}
+	idx := &BundleIndex{}
+	if err = json.NewDecoder(tr).Decode(idx); err != nil {
+		return nil, errors.Wrap(err, "parse "+bundleIndexName)
+	}
+	if err = os.MkdirAll(resourcesDir, 0755); err != nil {
+		return nil, err
+	}
+
+	// checksums are saved once a file imported, so files imported before an error can still be verified
+	imported := make(map[string]bool)
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read bundle")
+		}
+		name := strings.TrimPrefix(hdr.Name, bundleFilesDir)
+		bf, ok := idx.file(name)
+		if !ok || path.Base(name) != name {
+			return nil, fmt.Errorf("invalid bundle, %s not in index", hdr.Name)
+		}
+		if err = importBundleFile(tr, bf); err != nil {
+			return nil, err
+		}
+		if err = saveLocalChecksums(map[string]string{bf.Name: bf.SHA256}); err != nil {
+			return nil, errors.Wrap(err, "save checksums")
+		}
+		imported[bf.Name] = true
+	}
+	for _, bf := range idx.Files {
+		if _, ok := imported[bf.Name]; !ok {
+			return nil, fmt.Errorf("invalid bundle, %s missing", bf.Name)
+		}
+	}
+	for _, bf := range idx.Files {
+		// tar.gz are extracted by Component.Fetch when used
+		if bf.Install == INSTALL_ZIP {
+			if err = importZip(filepath.Join(resourcesDir, bf.Name)); err != nil {
+				return nil, errors.Wrap(err, bf.Name)
+			}
+		}
+	}
+	return idx, nil
+}
+
+func importZip(archive string) error {
+	unlock, err := lockResource(archive)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	_, err = extractZip(archive)
+	return err
+}
+
+// importBundleFile write to a temp file, and rename it only when sha256 matches
+func importBundleFile(rd io.Reader, bf BundleFile) error {
+	dst := filepath.Join(resourcesDir, bf.Name)
+	unlock, err := lockResource(dst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	tmpName := dst + partialFileSuffix
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), rd)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, bf.Name)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, bf.SHA256) {
+		return &ChecksumError{File: bf.Name, Expect: strings.ToLower(bf.SHA256), Got: got}
+	}
+	return os.Rename(tmpName, dst)
+}
+
+func runBundleExport(filename string) {
+	idx, err := exportBundle(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, bf := range idx.Files {
+		fmt.Printf("%s  %s\n", bf.SHA256, bf.Name)
+	}
+	fmt.Printf("%d files exported to %s\n", len(idx.Files), filename)
+}
+
+func runBundleImport(filename string) {
+	idx, err := importBundle(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, bf := range idx.Files {
+		fmt.Println("imported", bf.Name)
+	}
+	fmt.Printf("%d files imported into %s, bundle created at %s\n",
+		len(idx.Files), resourcesDir, idx.Created.Format(time.RFC3339))
+}
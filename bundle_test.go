@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestBundle(t *testing.T, dir string, content string, sum string) string {
+	resourcesDir = filepath.Join(dir, "src")
+	os.MkdirAll(resourcesDir, 0755)
+	if err := ioutil.WriteFile(filepath.Join(resourcesDir, "app-1.0.apk"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx := &BundleIndex{Created: time.Now(), Files: []BundleFile{
+		{Name: "app-1.0.apk", Component: "app", Version: "1.0", Install: INSTALL_APK, Size: int64(len(content)), SHA256: sum},
+	}}
+	filename := filepath.Join(dir, "bundle.tar.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := writeBundle(f, idx); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256 of "hello"
+	filename := writeTestBundle(t, dir, "hello", sum)
+	resourcesDir = filepath.Join(dir, "dst")
+	if _, err := importBundle(filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(resourcesDir, "app-1.0.apk"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("imported file expect hello, got %q %v", data, err)
+	}
+	if got, ok := localChecksum("app-1.0.apk"); !ok || got != sum {
+		t.Errorf("local checksum expect %s, got %s", sum, got)
+	}
+}
+
+func TestBundleImportChecksumMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+
+	filename := writeTestBundle(t, dir, "hello", "0000000000000000000000000000000000000000000000000000000000000000")
+	resourcesDir = filepath.Join(dir, "dst")
+	if _, err := importBundle(filename); err == nil {
+		t.Fatal("expect checksum error")
+	}
+	if _, err := os.Stat(filepath.Join(resourcesDir, "app-1.0.apk")); err == nil {
+		t.Error("file with wrong checksum should not be imported")
+	}
+}
+
+func TestBundleImportPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+
+	resourcesDir = filepath.Join(dir, "src")
+	os.MkdirAll(resourcesDir, 0755)
+	ioutil.WriteFile(filepath.Join(resourcesDir, "app-1.0.apk"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(resourcesDir, "app-2.0.apk"), []byte("world"), 0644)
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256 of "hello"
+	idx := &BundleIndex{Created: time.Now(), Files: []BundleFile{
+		{Name: "app-1.0.apk", Component: "app", Version: "1.0", Install: INSTALL_APK, Size: 5, SHA256: sum},
+		{Name: "app-2.0.apk", Component: "app", Version: "2.0", Install: INSTALL_APK, Size: 5, SHA256: sum},
+	}}
+	filename := filepath.Join(dir, "bundle.tar.gz")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeBundle(f, idx); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	resourcesDir = filepath.Join(dir, "dst")
+	if _, err := importBundle(filename); err == nil {
+		t.Fatal("expect checksum error of app-2.0.apk")
+	}
+	if got, ok := localChecksum("app-1.0.apk"); !ok || got != sum {
+		t.Errorf("checksum of imported app-1.0.apk should be saved, got %q", got)
+	}
+	if _, ok := localChecksum("app-2.0.apk"); ok {
+		t.Error("checksum of rejected app-2.0.apk should not be saved")
+	}
+}
+
+func TestManifestResources(t *testing.T) {
+	count := 0
+	for _, c := range defaultManifest().Resources() {
+		if c.Name == "atx-agent" {
+			count++
+		}
+	}
+	if count != len(allAgentArchs()) {
+		t.Errorf("expect one atx-agent for each of %v, got %d", allAgentArchs(), count)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/franela/goreq"
+	"github.com/openatx/u2init/flashget"
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+)
+
+// ChecksumError means the file content is not the expected one
+type ChecksumError struct {
+	File   string
+	Expect string
+	Got    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("verify %s: sha256 mismatch, expect %s, got %s", filepath.Base(e.File), e.Expect, e.Got)
+}
+
+// fileSHA256 is shared with flashget, so apks and resources are verified the same way
+func fileSHA256(filename string) (string, error) {
+	return flashget.FileSHA256(filename)
+}
+
+// verifyFile check file sha256, empty expect means no need to verify
+func verifyFile(filename string, expect string) error {
+	if expect == "" {
+		return nil
+	}
+	got, err := fileSHA256(filename)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(got, expect) {
+		return &ChecksumError{File: filename, Expect: strings.ToLower(expect), Got: got}
+	}
+	return nil
+}
+
+// quarantine move a broken file to resourcesDir/quarantine, so it can be checked later
+func quarantine(filename string) {
+	dir := filepath.Join(resourcesDir, "quarantine")
+	os.MkdirAll(dir, 0755)
+	dst := filepath.Join(dir, fmt.Sprintf("%s.%d", filepath.Base(filename), time.Now().Unix()))
+	if err := os.Rename(filename, dst); err != nil {
+		log.Warnf("quarantine %s: %v", filename, err)
+		os.Remove(filename)
+		return
+	}
+	log.Warnf("quarantine %s -> %s", filename, dst)
+}
+
+// parseChecksums parse content in format of sha256sum output
+//
+//	e3b0c44298fc1c149afbf4c8996fb924...  atx-agent_0.5.1_linux_armv6.tar.gz
+func parseChecksums(rd io.Reader) map[string]string {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(rd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+	}
+	return sums
+}
+
+// checksums files are fetched again after checksumsCacheTTL, in case a release is published again
+const checksumsCacheTTL = 10 * time.Minute
+
+type cachedChecksums struct {
+	sums      map[string]string
+	fetchedAt time.Time
+}
+
+var checksumsCache = struct {
+	sync.Mutex
+	m map[string]cachedChecksums
+}{m: make(map[string]cachedChecksums)}
+
+// ChecksumNotFoundError means the checksums file is served, but filename not listed
+// It is a problem of manifest or release, not of the mirror
+type ChecksumNotFoundError struct {
+	File string
+	URL  string
+}
+
+func (e *ChecksumNotFoundError) Error() string {
+	return fmt.Sprintf("checksum of %s not found in %s", e.File, e.URL)
+}
+
+// fetchChecksum get sha256 of filename from a checksums file published alongside the release
+func fetchChecksum(checksumURL string, filename string) (string, error) {
+	checksumsCache.Lock()
+	cached, ok := checksumsCache.m[checksumURL]
+	checksumsCache.Unlock()
+	if !ok || time.Since(cached.fetchedAt) > checksumsCacheTTL {
+		// not locked during GET, a slow mirror should not block lookups of other urls
+		sums, err := getChecksums(checksumURL)
+		if err != nil {
+			return "", err
+		}
+		cached = cachedChecksums{sums: sums, fetchedAt: time.Now()}
+		checksumsCache.Lock()
+		checksumsCache.m[checksumURL] = cached
+		checksumsCache.Unlock()
+	}
+	sum, ok := cached.sums[filename]
+	if !ok {
+		return "", &ChecksumNotFoundError{File: filename, URL: checksumURL}
+	}
+	return sum, nil
+}
+
+func getChecksums(checksumURL string) (map[string]string, error) {
+	res, err := goreq.Request{
+		Method:          "GET",
+		Uri:             checksumURL,
+		Timeout:         30 * time.Second,
+		MaxRedirects:    5,
+		RedirectHeaders: true,
+	}.Do()
+	if err != nil {
+		return nil, errors.Wrap(err, "get checksums")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("get checksums %s: status %d", checksumURL, res.StatusCode)
+	}
+	return parseChecksums(res.Body), nil
+}
+
+// localChecksumsFile in resourcesDir list sha256 of files imported from bundles or verified after download
+const localChecksumsFile = "SHA256SUMS"
+
+var localChecksumsMu sync.Mutex
+
+func readLocalChecksums() map[string]string {
+	f, err := os.Open(filepath.Join(resourcesDir, localChecksumsFile))
+	if err != nil {
+		return make(map[string]string)
+	}
+	defer f.Close()
+	return parseChecksums(f)
+}
+
+// localChecksum return sha256 of a file in resourcesDir recorded by bundle import or download
+func localChecksum(filename string) (string, bool) {
+	localChecksumsMu.Lock()
+	defer localChecksumsMu.Unlock()
+	sum, ok := readLocalChecksums()[filename]
+	return sum, ok
+}
+
+// saveLocalChecksums merge sums into resourcesDir/SHA256SUMS
+func saveLocalChecksums(sums map[string]string) error {
+	return updateLocalChecksums(func(merged map[string]string) {
+		for name, sum := range sums {
+			merged[name] = sum
+		}
+	})
+}
+
+// removeLocalChecksums remove entries of files deleted from resourcesDir
+func removeLocalChecksums(names []string) error {
+	return updateLocalChecksums(func(sums map[string]string) {
+		for _, name := range names {
+			delete(sums, name)
+		}
+	})
+}
+
+func updateLocalChecksums(update func(sums map[string]string)) error {
+	localChecksumsMu.Lock()
+	defer localChecksumsMu.Unlock()
+	filename := filepath.Join(resourcesDir, localChecksumsFile)
+	unlock, err := lockFile(filename) // other u2init sharing resourcesDir
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	merged := readLocalChecksums()
+	update(merged)
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintf(f, "%s  %s\n", merged[name], name)
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// Deprovisioner is implemented by steps which can remove what they installed
+type Deprovisioner interface {
+	Deprovision(d *ProvisionDevice, r *DeprovisionReport)
+}
+
+// DeprovisionReport record what was removed from device
+type DeprovisionReport struct {
+	Serial  string   `json:"serial"`
+	Removed []string `json:"removed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// RemoveFile rm file on device, only existing files are reported
+func (r *DeprovisionReport) RemoveFile(device *goadb.Device, filename string) {
+	if _, err := device.Stat(filename); err != nil {
+		return
+	}
+	output, err := runCommand(device, "rm", "-f", filename)
+	if err == nil && strings.TrimSpace(output) != "" {
+		err = fmt.Errorf("%s", strings.TrimSpace(output))
+	}
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("rm %s: %v", filename, err))
+		return
+	}
+	r.Removed = append(r.Removed, filename)
+}
+
+// UninstallPackage pm uninstall package, only installed packages are reported
+func (r *DeprovisionReport) UninstallPackage(device *goadb.Device, packageName string) {
+	if _, err := device.StatPackage(packageName); err != nil {
+		return
+	}
+	output, err := runCommand(device, "pm", "uninstall", packageName)
+	if err == nil && !strings.Contains(output, "Success") {
+		err = fmt.Errorf("%s", strings.TrimSpace(output))
+	}
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("uninstall %s: %v", packageName, err))
+		return
+	}
+	r.Removed = append(r.Removed, "package:"+packageName)
+}
+
+// deprovisionDevice undo all registered steps in reverse order, and remove temp files
+func deprovisionDevice(d *ProvisionDevice) *DeprovisionReport {
+	report := &DeprovisionReport{
+		Serial:  d.Serial,
+		Removed: make([]string, 0),
+	}
+	names := provisionSteps.Names()
+	for i := len(names) - 1; i >= 0; i-- {
+		step, _ := provisionSteps.Get(names[i])
+		if undo, ok := step.(Deprovisioner); ok {
+			log.Infof("%s deprovision %s", d.Serial, names[i])
+			undo.Deprovision(d, report)
+		}
+	}
+	// temp files of interrupted pushes and REST api installs
+	tmpDir := d.Keeper.quirk.TmpDir
+	patterns := []string{"/sdcard/tmp/u2init-*.apk", "/sdcard/tmp-*.apk"}
+	if tmpDir != defaultTmpDir {
+		patterns = append(patterns, tmpDir+"/u2init-*.apk")
+	}
+	for _, dir := range partialFileDirs(d.Keeper.quirk) {
+		patterns = append(patterns, dir+"/*"+partialFileSuffix)
+	}
+	for _, pattern := range patterns {
+		output, _ := runCommand(d.Device, "ls", pattern)
+		for _, filename := range strings.Fields(output) {
+			if path.IsAbs(filename) {
+				report.RemoveFile(d.Device, filename)
+			}
+		}
+	}
+	return report
+}
+
+func (k *ATXKeeper) deprovisionAgent(r *DeprovisionReport) {
+	if _, err := k.device.Stat(k.Agent.DevicePath); err != nil {
+		return
+	}
+	output, err := runCommand(k.device, PATHENV, "atx-agent", "server", "--stop")
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("stop atx-agent: %v", err))
+	} else {
+		log.Infof("stop atx-agent: %s", strings.TrimSpace(output))
+	}
+	r.RemoveFile(k.device, k.Agent.DevicePath)
+	if _, err := k.device.Stat(k.Agent.DevicePath + agentBackupSuffix); err == nil {
+		r.RemoveFile(k.device, k.Agent.DevicePath+agentBackupSuffix)
+	}
+}
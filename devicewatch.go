@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+	"github.com/yosemite-open/go-adb/wire"
+)
+
+// Raw device states reported by adb host:track-devices
+// go-adb only knows a few of them, and stops watching on the others, so devices are tracked by u2init itself
+const (
+	ADB_STATE_DEVICE         = "device"
+	ADB_STATE_DISCONNECTED   = "" // not listed by adb
+	ADB_STATE_OFFLINE        = "offline"
+	ADB_STATE_UNAUTHORIZED   = "unauthorized"
+	ADB_STATE_RECOVERY       = "recovery"
+	ADB_STATE_SIDELOAD       = "sideload"
+	ADB_STATE_BOOTLOADER     = "bootloader"
+	ADB_STATE_AUTHORIZING    = "authorizing"
+	ADB_STATE_CONNECTING     = "connecting"
+	ADB_STATE_NO_PERMISSIONS = "no permissions" // followed by a reason, eg: (user in plugdev group; are your udev rules wrong?)
+)
+
+// DeviceEvent is a change of adb state of a device
+type DeviceEvent struct {
+	Serial   string
+	OldState string
+	NewState string
+}
+
+// CameOnline return true if device can be used through adb now
+func (e DeviceEvent) CameOnline() bool {
+	return e.OldState != ADB_STATE_DEVICE && e.NewState == ADB_STATE_DEVICE
+}
+
+// parseDeviceStates parse message of host:track-devices, every line is "${SERIAL}\t${STATE}"
+func parseDeviceStates(msg string) map[string]string {
+	states := make(map[string]string)
+	for _, line := range strings.Split(msg, "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		states[fields[0]] = fields[1]
+	}
+	return states
+}
+
+func diffDeviceStates(oldStates, newStates map[string]string) []DeviceEvent {
+	events := make([]DeviceEvent, 0)
+	for serial, oldState := range oldStates {
+		if newState := newStates[serial]; newState != oldState {
+			events = append(events, DeviceEvent{Serial: serial, OldState: oldState, NewState: newState})
+		}
+	}
+	for serial, newState := range newStates {
+		if _, ok := oldStates[serial]; !ok {
+			events = append(events, DeviceEvent{Serial: serial, NewState: newState})
+		}
+	}
+	return events
+}
+
+func trackDevices(client *goadb.Adb) (*wire.Conn, error) {
+	conn, err := client.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if err = wire.SendMessageString(conn, "host:track-devices"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err = conn.ReadStatus("host:track-devices"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// watchDevices send events of device state changes, adb server is started again if it died
+func watchDevices(client *goadb.Adb) <-chan DeviceEvent {
+	eventC := make(chan DeviceEvent)
+	go func() {
+		states := make(map[string]string)
+		for {
+			err := publishDeviceEvents(client, eventC, &states)
+			log.Warnf("track devices: %v, retry after 1s", err)
+			time.Sleep(time.Second)
+			if err = client.StartServer(); err != nil {
+				log.Warnf("start adb server: %v", err)
+			}
+		}
+	}()
+	return eventC
+}
+
+func publishDeviceEvents(client *goadb.Adb, eventC chan<- DeviceEvent, states *map[string]string) error {
+	conn, err := trackDevices(client)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		newStates := parseDeviceStates(string(msg))
+		for _, event := range diffDeviceStates(*states, newStates) {
+			eventC <- event
+		}
+		*states = newStates
+	}
+}
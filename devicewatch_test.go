@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceStates(t *testing.T) {
+	msg := "3ffecdf\tdevice\nEP7333W7XB\tunauthorized\n0123456789ABCDEF\tno permissions (user in plugdev group; are your udev rules wrong?)\n\n"
+	expect := map[string]string{
+		"3ffecdf":          ADB_STATE_DEVICE,
+		"EP7333W7XB":       ADB_STATE_UNAUTHORIZED,
+		"0123456789ABCDEF": "no permissions (user in plugdev group; are your udev rules wrong?)",
+	}
+	if got := parseDeviceStates(msg); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %v, got %v", expect, got)
+	}
+}
+
+func TestDiffDeviceStates(t *testing.T) {
+	oldStates := map[string]string{"a": ADB_STATE_UNAUTHORIZED, "b": ADB_STATE_DEVICE, "c": ADB_STATE_DEVICE}
+	newStates := map[string]string{"a": ADB_STATE_DEVICE, "c": ADB_STATE_DEVICE, "d": ADB_STATE_RECOVERY}
+	events := make(map[string]DeviceEvent)
+	for _, e := range diffDeviceStates(oldStates, newStates) {
+		events[e.Serial] = e
+	}
+	if len(events) != 3 {
+		t.Fatalf("expect 3 events, got %v", events)
+	}
+	if !events["a"].CameOnline() {
+		t.Errorf("a should came online")
+	}
+	if events["b"].NewState != ADB_STATE_DISCONNECTED {
+		t.Errorf("b should be disconnected, got %q", events["b"].NewState)
+	}
+	if e := events["d"]; e.OldState != ADB_STATE_DISCONNECTED || e.NewState != ADB_STATE_RECOVERY || e.CameOnline() {
+		t.Errorf("d should be added in recovery, got %+v", e)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver"
+	"github.com/pkg/errors"
+)
+
+// extractDir is where archive extracted, named by sha256 of the archive
+// The dir is never changed once exists, a new archive is extracted into a new dir
+func extractDir(archive string, sum string) string {
+	if len(sum) > 12 {
+		sum = sum[:12]
+	}
+	ext := filepath.Ext(archive)
+	if strings.HasSuffix(archive, ".tar.gz") {
+		ext = ".tar.gz"
+	}
+	return strings.TrimSuffix(archive, ext) + "@" + sum
+}
+
+// extractAtomic extract into a temp dir, then rename it to dst, so readers never see a partial dir
+func extractAtomic(dst string, extract func(dir string) error) error {
+	tmp := dst + partialFileSuffix
+	os.RemoveAll(tmp) // left by a crashed extraction
+	if err := extract(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// extractVersioned extract archive into its versioned dir if not yet
+func extractVersioned(archive string, unarchive func(source, destination string) error) (dir string, err error) {
+	sum, err := cachedFileSHA256(archive)
+	if err != nil {
+		return "", err
+	}
+	dir = extractDir(archive, sum)
+	if fileExists(dir) {
+		return dir, nil
+	}
+	err = extractAtomic(dir, func(tmp string) error {
+		return unarchive(archive, tmp)
+	})
+	return dir, errors.Wrap(err, "unzip files")
+}
+
+func extractTarGz(archive string) (dir string, err error) {
+	return extractVersioned(archive, archiver.DefaultTarGz.Unarchive)
+}
+
+// extractZip extract like tar.gz, a zip downloaded again is extracted into a new dir,
+// so files of the old one are never moved away under readers
+func extractZip(archive string) (dir string, err error) {
+	return extractVersioned(archive, archiver.DefaultZip.Unarchive)
+}
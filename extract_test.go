@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractDir(t *testing.T) {
+	got := extractDir("resources/atx-agent-0.5.1-armv7.tar.gz", "e3b0c44298fc1c149afbf4c8996fb924")
+	if expect := "resources/atx-agent-0.5.1-armv7@e3b0c44298fc"; got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+	got = extractDir("resources/stf-binaries-0.2.zip", "e3b0c44298fc1c149afbf4c8996fb924")
+	if expect := "resources/stf-binaries-0.2@e3b0c44298fc"; got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+}
+
+func TestExtractAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "atx-agent-0.5.1-armv7@e3b0c44298fc")
+	err = extractAtomic(dst, func(tmp string) error {
+		os.MkdirAll(tmp, 0755)
+		ioutil.WriteFile(filepath.Join(tmp, "atx-agent"), []byte("half"), 0755)
+		return errors.New("disk full")
+	})
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	if fileExists(dst) || fileExists(dst+partialFileSuffix) {
+		t.Error("partial dir should be removed")
+	}
+
+	err = extractAtomic(dst, func(tmp string) error {
+		os.MkdirAll(tmp, 0755)
+		return ioutil.WriteFile(filepath.Join(tmp, "atx-agent"), []byte("agent"), 0755)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dst, "atx-agent")); string(data) != "agent" {
+		t.Errorf("expect agent, got %q", data)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "atx-agent-0.5.1-armv7.tar.gz")
+	unlock, err := lockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		unlock2, err := lockFile(path)
+		if err == nil {
+			unlock2()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("second lock should wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("second lock not got after unlock")
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeZip := func(content string) string {
+		archive := filepath.Join(dir, "stf-binaries-0.2.zip")
+		f, err := os.Create(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw := zip.NewWriter(f)
+		w, _ := zw.Create("stf-binaries-0.2/node_modules/minitouch")
+		w.Write([]byte(content))
+		zw.Close()
+		f.Close()
+		return archive
+	}
+	old, err := extractZip(writeZip("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// downloaded again, readers of the old dir are not affected
+	time.Sleep(10 * time.Millisecond)
+	dst, err := extractZip(writeZip("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old == dst {
+		t.Fatalf("expect a new dir, got %s", dst)
+	}
+	for path, expect := range map[string]string{old: "old", dst: "new"} {
+		data, _ := ioutil.ReadFile(filepath.Join(path, "stf-binaries-0.2/node_modules/minitouch"))
+		if string(data) != expect {
+			t.Errorf("expect %s in %s, got %q", expect, filepath.Base(path), data)
+		}
+	}
+}
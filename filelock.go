@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile take an exclusive lock of path shared by u2init processes, blocks until got
+// Lock files are kept in dir .locks beside path, and never removed
+func lockFile(path string) (unlock func(), err error) {
+	dir := filepath.Join(filepath.Dir(path), ".locks")
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, filepath.Base(path)+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = flock(f); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "lock "+path)
+	}
+	return func() {
+		funlock(f)
+		f.Close()
+	}, nil
+}
+
+// lockResource lock path for goroutines and other u2init processes sharing resourcesDir
+func lockResource(path string) (unlock func(), err error) {
+	unlockMutex := resourceLocks.Lock(path)
+	unlockFile, err := lockFile(path)
+	if err != nil {
+		unlockMutex()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		unlockMutex()
+	}, nil
+}
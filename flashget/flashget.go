@@ -1,12 +1,16 @@
 package flashget
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,16 +36,38 @@ type Downloader struct {
 	CreatedAt     time.Time `json:"createdAt"`
 	FinishedAt    time.Time `json:"finishedAt"`
 	AccessedAt    time.Time `json:"accessedAt"` // TODO(ssx): need to use some times
+	SHA256        string    `json:"sha256"`
+	Source        string    `json:"source,omitempty"` // url the file downloaded from
 	wg            sync.WaitGroup
+	mu            sync.Mutex
 	resp          *grab.Response
 }
 
+// Source is a url to download from, eg: the same file in another mirror
+type Source struct {
+	URL     string
+	Timeout time.Duration // 0 means no limit
+	Tag     string        // passed to OnSourceResult, eg: mirror name
+}
+
+func (dl *Downloader) response() *grab.Response {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	return dl.resp
+}
+
+func (dl *Downloader) setResponse(resp *grab.Response) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.resp = resp
+}
+
 func (dl *Downloader) Wait() {
 	dl.wg.Wait()
 }
 
 func (dl *Downloader) Written() int64 {
-	return dl.resp.BytesComplete()
+	return dl.response().BytesComplete()
 }
 
 func (dl *Downloader) Finished() bool {
@@ -63,7 +89,7 @@ func (dl *Downloader) Remove() bool {
 }
 
 func (dl *Downloader) HumanSpeed() string {
-	byteps := uint64(dl.resp.BytesPerSecond())
+	byteps := uint64(dl.response().BytesPerSecond())
 	return bytefmt.ByteSize(byteps) + "/s"
 }
 
@@ -71,6 +97,30 @@ func (dl *Downloader) HumanSpeed() string {
 type DownloadManager struct {
 	downloads map[string]*Downloader
 	mu        sync.RWMutex
+
+	// Sources return urls to try in order for url, nil means url itself
+	Sources func(url string, checksum string) []Source
+	// OnSourceResult is called after downloading from each source, written is bytes received
+	OnSourceResult func(url string, src Source, written int64, err error)
+	// OnCacheHit is called when url already downloaded or downloading
+	OnCacheHit func(url string)
+	// OnCacheMiss is called when url need to be downloaded
+	OnCacheMiss func(url string)
+	// Quarantine keep a file not match checksum for later check, nil means remove it
+	Quarantine func(filename string)
+}
+
+// Stats is status of DownloadManager
+type Stats struct {
+	CacheSize int64 // size of finished downloads
+}
+
+func (dm *DownloadManager) Stats() Stats {
+	st := Stats{}
+	for _, dl := range dm.FinishedDownloads() {
+		st.CacheSize += dl.ContentLength
+	}
+	return st
 }
 
 func NewDownloadManager() *DownloadManager {
@@ -165,34 +215,61 @@ func (dm *DownloadManager) locate(url string) *Downloader {
 
 // Retrive url as local file
 func (dm *DownloadManager) Retrive(url string) (dl *Downloader, err error) {
+	return dm.RetriveWithChecksum(url, "")
+}
+
+// RetriveWithChecksum is same as Retrive, but the file must match sha256 if not empty
+// A cached file not match will be removed and downloaded again
+func (dm *DownloadManager) RetriveWithChecksum(url string, checksum string) (dl *Downloader, err error) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
 	dl = dm.locate(url)
+	if dl != nil && !dl.matchChecksum(checksum) {
+		log.Warnf("cached file of url %s sha256 mismatch, expect %s, got %s", url, checksum, dl.SHA256)
+		dm.quarantine(dl.Filename)
+		delete(dm.downloads, url)
+		dl = nil
+	}
 	if dl != nil {
 		log.Infof("already download url: %s", url)
+		if dm.OnCacheHit != nil {
+			dm.OnCacheHit(url)
+		}
 		return
 	}
+	if dm.OnCacheMiss != nil {
+		dm.OnCacheMiss(url)
+	}
 
-	// check if url valid
-	// GET need to support ranges
-	log.Infof("check url: %s", url)
+	sources := []Source{{URL: url}}
+	if dm.Sources != nil {
+		if srcs := dm.Sources(url, checksum); len(srcs) > 0 {
+			sources = srcs
+		}
+	}
 	filename := dm.url2filename(url)
 	tmpfilename := filename + ".cache"
-	client := grab.NewClient()
 
-	req, err := grab.NewRequest(tmpfilename, url)
-	if err != nil {
+	// GET need to support ranges
+	// try sources until one started, the rest are tried in background if it failed
+	var resp *grab.Response
+	var cancel context.CancelFunc
+	for len(sources) > 0 {
+		if resp, cancel, err = dm.get(tmpfilename, sources[0]); err == nil {
+			break
+		}
+		log.Warnf("download failed, url: %s, %v", sources[0].URL, err)
+		dm.sourceResult(url, sources[0], 0, err)
+		sources = sources[1:]
+	}
+	if resp == nil {
 		return nil, err
 	}
-	fmt.Printf("Downloading %v...\n", req.URL())
-
-	resp := client.Do(req)
 
 	// create download file
 	log.Infof("create download %s", url)
 
-	// dl = dm.newDownloader(f)
 	dl = dm.newDownloader(resp)
 	dl.URL = url
 	dl.Filename = filename
@@ -205,27 +282,81 @@ func (dm *DownloadManager) Retrive(url string) (dl *Downloader, err error) {
 		defer dl.wg.Done()
 		defer func() { dl.FinishedAt = time.Now() }()
 
-		<-resp.Done
-
-		if err := resp.Err(); err != nil {
-			dl.Status = STATUS_FAILURE
-			dl.Description = err.Error()
-			os.Remove(tmpfilename)
-			log.Warnf("download failed, url: %s", url)
-			return
+		var err error
+		for i, src := range sources {
+			if i > 0 {
+				if resp, cancel, err = dm.get(tmpfilename, src); err != nil {
+					dm.sourceResult(url, src, 0, err)
+					continue
+				}
+				dl.setResponse(resp)
+			}
+			err = dm.download(dl, resp, checksum)
+			cancel()
+			dm.sourceResult(url, src, resp.BytesComplete(), err)
+			if err == nil {
+				dl.Source = src.URL
+				dl.Status = STATUS_SUCCESS
+				log.Infof("download save to %v", filename)
+				return
+			}
+			log.Warnf("download failed, url: %s, %v", src.URL, err)
 		}
-
-		if err = os.Rename(tmpfilename, filename); err != nil {
-			dl.Status = STATUS_FAILURE
-			dl.Description = "file rename err: " + err.Error()
-			return
-		}
-		dl.Status = STATUS_SUCCESS
-		log.Infof("download save to %v", resp.Filename)
+		dl.Status = STATUS_FAILURE
+		dl.Description = err.Error()
 	}()
 	return dl, nil
 }
 
+func (dm *DownloadManager) sourceResult(url string, src Source, written int64, err error) {
+	if dm.OnSourceResult != nil {
+		dm.OnSourceResult(url, src, written, err)
+	}
+}
+
+// get start downloading src into filename, with timeout of src
+// cancel must be called after the response done
+func (dm *DownloadManager) get(filename string, src Source) (resp *grab.Response, cancel context.CancelFunc, err error) {
+	req, err := grab.NewRequest(filename, src.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ctx context.Context
+	if src.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), src.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	fmt.Printf("Downloading %v...\n", req.URL())
+	return grab.NewClient().Do(req.WithContext(ctx)), cancel, nil
+}
+
+// download wait resp done, then verify and rename it to dl.Filename
+func (dm *DownloadManager) download(dl *Downloader, resp *grab.Response, checksum string) error {
+	<-resp.Done
+
+	if err := resp.Err(); err != nil {
+		os.Remove(resp.Filename)
+		return err
+	}
+
+	sum, err := FileSHA256(resp.Filename)
+	if err != nil {
+		os.Remove(resp.Filename)
+		return fmt.Errorf("sha256 err: %v", err)
+	}
+	dl.SHA256 = sum
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		dm.quarantine(resp.Filename)
+		return fmt.Errorf("sha256 mismatch, expect %s, got %s", checksum, sum)
+	}
+
+	if err = os.Rename(resp.Filename, dl.Filename); err != nil {
+		return fmt.Errorf("file rename err: %v", err)
+	}
+	return nil
+}
+
 func (dm *DownloadManager) EnableAutoRecycle() {
 	// TODO(ssx): load already downloaded file
 	filepath.Walk("./", func(path string, info os.FileInfo, err error) error {
@@ -269,6 +400,43 @@ func (dm *DownloadManager) Recycle() {
 	}
 }
 
+// matchChecksum compare sha256 of downloaded file, empty checksum always match
+func (dl *Downloader) matchChecksum(checksum string) bool {
+	if checksum == "" || dl.Status == STATUS_DOWNLOADING {
+		return true
+	}
+	if dl.SHA256 == "" {
+		sum, err := FileSHA256(dl.Filename)
+		if err != nil {
+			return false
+		}
+		dl.SHA256 = sum
+	}
+	return strings.EqualFold(dl.SHA256, checksum)
+}
+
+// FileSHA256 return hex encoded sha256 of file content
+func FileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (dm *DownloadManager) quarantine(filename string) {
+	if dm.Quarantine != nil {
+		dm.Quarantine(filename)
+		return
+	}
+	os.Remove(filename)
+}
+
 func hashStr(str string) string {
 	h := md5.New()
 	h.Write([]byte(str))
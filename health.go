@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/franela/goreq"
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+const maxHealthHistory = 20
+
+var healthChecker = NewHealthChecker(30 * time.Second)
+
+// HealthRecord is the result of one health check
+type HealthRecord struct {
+	Time        time.Time `json:"time"`
+	Agent       bool      `json:"agent"`
+	Uiautomator bool      `json:"uiautomator"`
+	Minicap     bool      `json:"minicap"`
+	Actions     []string  `json:"actions,omitempty"` // components restarted
+	Skipped     []string  `json:"skipped,omitempty"` // components down, but pinned to skip so not restarted
+	Errors      []string  `json:"errors,omitempty"`
+	PolicyDrift []string  `json:"policyDrift,omitempty"`
+}
+
+// Healthy return true if nothing need to be restarted and policy not changed
+func (r HealthRecord) Healthy() bool {
+	return len(r.Actions) == 0 && len(r.Skipped) == 0 && len(r.Errors) == 0 && len(r.PolicyDrift) == 0
+}
+
+// HealthChecker check ready devices periodically, restart components which are down
+type HealthChecker struct {
+	Interval time.Duration
+
+	mu       sync.Mutex
+	history  map[string][]HealthRecord
+	watching map[string]context.CancelFunc
+}
+
+func NewHealthChecker(interval time.Duration) *HealthChecker {
+	return &HealthChecker{
+		Interval: interval,
+		history:  make(map[string][]HealthRecord),
+		watching: make(map[string]context.CancelFunc),
+	}
+}
+
+func (hc *HealthChecker) add(serial string, record HealthRecord) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	records := append(hc.history[serial], record)
+	if len(records) > maxHealthHistory {
+		records = records[len(records)-maxHealthHistory:]
+	}
+	hc.history[serial] = records
+}
+
+// History return health records of device, the latest last
+func (hc *HealthChecker) History(serial string) []HealthRecord {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	return append([]HealthRecord{}, hc.history[serial]...)
+}
+
+// Watch start checking device until ctx is done, the previous watch of the same device is stopped
+func (hc *HealthChecker) Watch(ctx context.Context, serial string, check func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	hc.mu.Lock()
+	if stop, ok := hc.watching[serial]; ok {
+		stop()
+	}
+	hc.watching[serial] = cancel
+	hc.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(hc.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check(ctx)
+			}
+		}
+	}()
+}
+
+// Stop checking device, called when device went offline or deprovisioned
+func (hc *HealthChecker) Stop(serial string) {
+	if hc == nil {
+		return
+	}
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if stop, ok := hc.watching[serial]; ok {
+		stop()
+		delete(hc.watching, serial)
+	}
+}
+
+func agentAlive(port int) bool {
+	if port == 0 {
+		return false
+	}
+	res, err := goreq.Request{
+		Method:  "GET",
+		Uri:     fmt.Sprintf("http://127.0.0.1:%d/info", port),
+		Timeout: 3 * time.Second,
+	}.Do()
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	return res.StatusCode == 200
+}
+
+func processRunning(device *goadb.Device, name string) bool {
+	output, err := runCommand(device, "pidof", name)
+	if err == nil && strings.TrimSpace(output) != "" {
+		return true
+	}
+	// pidof is not available before Android 6.0
+	ps, err := device.ListProcesses()
+	if err != nil {
+		return false
+	}
+	for _, p := range ps {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rerunStep run a provision step again, used to restore a component
+func (lc *Lifecycle) rerunStep(ctx context.Context, serial string, name string) error {
+	step, ok := provisionSteps.Get(name)
+	if !ok {
+		return fmt.Errorf("unknown provision step: %s", name)
+	}
+	pd, err := newProvisionDevice(ctx, adb.Device(goadb.DeviceWithSerial(serial)), lc.ServerAddr)
+	if err != nil {
+		return err
+	}
+	result := runStep(step, pd)
+	if result.Status == STEP_FAILURE {
+		return errors.Wrap(result.err, name)
+	}
+	return nil
+}
+
+// healthPinNames is the pinned component of what checkHealth restarts
+var healthPinNames = map[string]string{
+	"atx-agent":   "atx-agent",
+	"uiautomator": "app-uiautomator",
+}
+
+// checkHealth check atx-agent, uiautomator and minicap, restart the ones not working
+func (lc *Lifecycle) checkHealth(ctx context.Context, serial string) {
+	d, ok := dm.Get(serial)
+	if !ok || (d.State != DEVICE_READY && d.State != DEVICE_DEGRADED) {
+		return
+	}
+	device := adb.Device(goadb.DeviceWithSerial(serial))
+	record := HealthRecord{Time: time.Now()}
+	devicePins := pins.Get(serial)
+	restore := func(component string, fn func() error) {
+		if devicePins[healthPinNames[component]] == PIN_SKIP {
+			record.Skipped = append(record.Skipped, component)
+			log.Warnf("%s %s is down, pinned to skip, not restarted", serial, component)
+			return
+		}
+		record.Actions = append(record.Actions, "restart "+component)
+		log.Warnf("%s %s is down, restart it", serial, component)
+		if err := fn(); err != nil {
+			record.Errors = append(record.Errors, fmt.Sprintf("restart %s: %v", component, err))
+		}
+	}
+
+	record.Agent = agentAlive(d.AgentPort)
+	if !record.Agent {
+		restore("atx-agent", func() error {
+			if err := lc.rerunStep(ctx, serial, "atx-agent"); err != nil {
+				return err
+			}
+			_, port, err := deviceUdid(device)
+			if err == nil {
+				d, _ = dm.Modify(serial, func(d *ADevice) { d.AgentPort = port })
+			}
+			return err
+		})
+	}
+
+	if d.Capabilities.Uiautomator {
+		record.Uiautomator = processRunning(device, "com.github.uiautomator")
+		if !record.Uiautomator {
+			restore("uiautomator", func() error {
+				if !uiautomatorInstalled(device) {
+					if err := lc.rerunStep(ctx, serial, "uiautomator"); err != nil {
+						return err
+					}
+				}
+				return startService(device)
+			})
+		}
+	}
+
+	if d.Capabilities.Screenshot {
+		record.Minicap = probeMinicap(device)
+		if !record.Minicap {
+			restore("minicap", func() error {
+				return lc.rerunStep(ctx, serial, "minitools")
+			})
+		}
+	}
+
+	if provisionSteps.Enabled("device-policy") {
+		record.PolicyDrift = checkPolicy(device, manifest.Policy)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+	history := lc.health.History(serial)
+	lc.health.add(serial, record)
+	d, ok = dm.Modify(serial, func(d *ADevice) {
+		d.Health = &record
+		d.PolicyDrift = record.PolicyDrift
+	})
+	if !ok {
+		return
+	}
+	// only report to server when health changed
+	if len(history) == 0 || history[len(history)-1].Healthy() != record.Healthy() {
+		lc.report(d)
+	}
+}
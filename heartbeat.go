@@ -73,12 +73,15 @@ func (h *HeartbeatClient) sendData(data interface{}) error {
 		Timeout: 2 * time.Second,
 	}.Do()
 	if err != nil {
+		metricHeartbeats.Inc("failure")
 		return err
 	}
 	defer res.Body.Close()
 	if res.StatusCode == 200 {
+		metricHeartbeats.Inc("success")
 		return nil
 	}
+	metricHeartbeats.Inc("failure")
 	desc, _ := res.Body.ToString()
 	return errors.New("heartbeat err: " + desc)
 }
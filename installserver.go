@@ -102,7 +102,7 @@ func registerHTTPHandler() {
 		io.WriteString(w, id)
 
 		go func() {
-			defer device.RunCommand("rm", tmpPath)
+			defer runCommand(device, "rm", tmpPath)
 			defer dashboard.DeleteAfter(id, 5*time.Minute)
 
 			<-aw.Done
@@ -114,7 +114,7 @@ func registerHTTPHandler() {
 
 			state.State = "installing"
 			// do install
-			output, err := device.RunCommand("pm", "install", "-r", "-t", tmpPath)
+			output, err := runCommand(device, "pm", "install", "-r", "-t", tmpPath)
 			if err != nil {
 				state.State = "err: " + err.Error() + ":" + output
 				return
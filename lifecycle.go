@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// Device states
+const (
+	DEVICE_DETECTED     = "detected"
+	DEVICE_UNAUTHORIZED = "unauthorized"
+	DEVICE_INITIALIZING = "initializing"
+	DEVICE_READY        = "ready"
+	DEVICE_DEGRADED     = "degraded" // usable, but some features not working
+	DEVICE_FAILED       = "failed"
+	DEVICE_OFFLINE      = "offline"
+
+	DEVICE_DEPROVISIONED = "deprovisioned" // everything removed by request, not inited until plugged in again
+
+	// connected, but adb can not be used
+	DEVICE_ADB_OFFLINE    = "adb-offline"
+	DEVICE_RECOVERY       = "recovery"
+	DEVICE_SIDELOAD       = "sideload"
+	DEVICE_BOOTLOADER     = "bootloader"
+	DEVICE_NO_PERMISSIONS = "no-permissions"
+	DEVICE_AUTHORIZING    = "authorizing"
+	DEVICE_CONNECTING     = "connecting"
+	DEVICE_UNKNOWN        = "unknown"
+)
+
+// stateHints tell operators what to do with devices can not be provisioned
+var stateHints = map[string]string{
+	DEVICE_OFFLINE:        "device is unplugged",
+	DEVICE_UNAUTHORIZED:   "allow USB debugging on the phone, check \"Always allow from this computer\"",
+	DEVICE_ADB_OFFLINE:    "adb can not talk to the device, replug the USB cable or restart adb server",
+	DEVICE_RECOVERY:       "device is in recovery mode, reboot it into system",
+	DEVICE_SIDELOAD:       "device is waiting for adb sideload, reboot it into system",
+	DEVICE_BOOTLOADER:     "device is in bootloader mode, reboot it into system",
+	DEVICE_NO_PERMISSIONS: "no permission to open the USB device, check udev rules of the host",
+	DEVICE_AUTHORIZING:    "device is being authorized, wait a moment",
+	DEVICE_CONNECTING:     "adb is connecting to the device, wait a moment",
+	DEVICE_UNKNOWN:        "unknown adb state, upgrade adb and u2init",
+}
+
+// deviceState convert raw adb state into device state
+func deviceState(state string) string {
+	switch state {
+	case ADB_STATE_DEVICE:
+		return DEVICE_DETECTED
+	case ADB_STATE_DISCONNECTED:
+		return DEVICE_OFFLINE
+	case ADB_STATE_UNAUTHORIZED:
+		return DEVICE_UNAUTHORIZED
+	case ADB_STATE_OFFLINE:
+		return DEVICE_ADB_OFFLINE
+	case ADB_STATE_RECOVERY:
+		return DEVICE_RECOVERY
+	case ADB_STATE_SIDELOAD:
+		return DEVICE_SIDELOAD
+	case ADB_STATE_BOOTLOADER:
+		return DEVICE_BOOTLOADER
+	case ADB_STATE_AUTHORIZING:
+		return DEVICE_AUTHORIZING
+	case ADB_STATE_CONNECTING:
+		return DEVICE_CONNECTING
+	}
+	if strings.HasPrefix(state, ADB_STATE_NO_PERMISSIONS) {
+		return DEVICE_NO_PERMISSIONS
+	}
+	return DEVICE_UNKNOWN
+}
+
+// unavailable return true if device is not connected or can not be used through adb
+func unavailable(state string) bool {
+	_, ok := stateHints[state]
+	return ok
+}
+
+const (
+	retryMinBackoff = 10 * time.Second
+	retryMaxBackoff = 5 * time.Minute
+)
+
+// retryBackoff return how long to wait before the next attempt, doubled after every failure
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryMinBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= retryMaxBackoff {
+			return retryMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Lifecycle handle device events, keep device state in DeviceManager and report to atx-server
+type Lifecycle struct {
+	ServerAddr string
+	heart      *HeartbeatClient
+	workers    *DeviceWorkers
+	health     *HealthChecker
+
+	// heartbeats waiting to be sent, only the latest one of a device is kept, nil means offline
+	reportMu   sync.Mutex
+	reports    map[string]map[string]interface{}
+	reportC    chan bool
+	reportOnce sync.Once
+}
+
+func stateUpdater(state string, err error) func(d *ADevice) {
+	return func(d *ADevice) {
+		d.State = state
+		d.Hint = stateHints[state]
+		if err != nil {
+			d.LastError = err.Error()
+		}
+	}
+}
+
+// setState change state of a device reported by adb, it is added if not known yet
+func (lc *Lifecycle) setState(serial string, state string, err error) ADevice {
+	d := dm.Update(serial, stateUpdater(state, err))
+	lc.report(d)
+	return d
+}
+
+// changeState is setState for tasks run after the event, eg: init and retry
+// A device already removed is not added back
+func (lc *Lifecycle) changeState(serial string, state string, err error) {
+	if d, ok := dm.Modify(serial, stateUpdater(state, err)); ok {
+		lc.report(d)
+	}
+}
+
+// report send device state to atx-server, status is online only when the device is usable
+// A ready device being checked again is still usable, so keep it online
+func (lc *Lifecycle) report(d ADevice) {
+	if lc.heart == nil {
+		return
+	}
+	status := "offline"
+	switch d.State {
+	case DEVICE_READY, DEVICE_DEGRADED:
+		status = "online"
+	case DEVICE_INITIALIZING:
+		if d.Udid != "" {
+			status = "online"
+		}
+	}
+	data := map[string]interface{}{
+		"serial":         d.Serial,
+		"status":         status,
+		"provisionState": d.State,
+		"attempts":       d.Attempts,
+		"capabilities":   d.Capabilities,
+	}
+	if d.Udid != "" {
+		data["udid"] = d.Udid
+		data["providerForwardedPort"] = d.AgentPort
+	}
+	if d.LastError != "" {
+		data["lastError"] = d.LastError
+	}
+	if d.Hint != "" {
+		data["hint"] = d.Hint
+	}
+	if d.Health != nil {
+		data["health"] = d.Health
+	}
+	if len(d.PolicyDrift) > 0 {
+		data["policyDrift"] = d.PolicyDrift
+	}
+	lc.send(d.Serial, data)
+}
+
+// send queue data for the heartbeat goroutine, so a slow atx-server never blocks device events
+func (lc *Lifecycle) send(serial string, data map[string]interface{}) {
+	if lc.heart == nil {
+		return
+	}
+	lc.reportOnce.Do(func() {
+		lc.reportC = make(chan bool, 1)
+		go lc.sendReports()
+	})
+	lc.reportMu.Lock()
+	if lc.reports == nil {
+		lc.reports = make(map[string]map[string]interface{})
+	}
+	lc.reports[serial] = data
+	lc.reportMu.Unlock()
+	select {
+	case lc.reportC <- true:
+	default:
+	}
+}
+
+func (lc *Lifecycle) sendReports() {
+	for range lc.reportC {
+		lc.reportMu.Lock()
+		reports := lc.reports
+		lc.reports = nil
+		lc.reportMu.Unlock()
+		for serial, data := range reports {
+			if data == nil {
+				lc.heart.Delete(serial)
+			} else {
+				lc.heart.AddData(serial, data)
+			}
+		}
+	}
+}
+
+func (lc *Lifecycle) Online(serial string) {
+	d, exists := dm.Get(serial)
+	if !exists || unavailable(d.State) {
+		lc.setState(serial, DEVICE_DETECTED, nil)
+	}
+	lc.stopRetry(serial)
+	lc.workers.Online(serial, func(ctx context.Context) {
+		lc.initDevice(ctx, serial)
+	})
+}
+
+// stopRetry cancel the init scheduled after failure, before another init queued or device gone
+func (lc *Lifecycle) stopRetry(serial string) {
+	dm.Modify(serial, func(d *ADevice) {
+		if d.retryTimer != nil {
+			d.retryTimer.Stop()
+			d.retryTimer = nil
+			d.NextRetryAt = nil
+		}
+	})
+}
+
+func (lc *Lifecycle) Offline(serial string) {
+	lc.health.Stop(serial)
+	lc.stopRetry(serial)
+	lc.workers.Offline(serial, func() {
+		dm.Modify(serial, func(d *ADevice) {
+			d.State = DEVICE_OFFLINE
+			d.Hint = stateHints[DEVICE_OFFLINE]
+			d.Attempts = 0
+			d.NextRetryAt = nil
+			d.Udid = ""
+			d.AgentPort = 0
+		})
+		lc.send(serial, nil)
+	})
+}
+
+// Deprovision cancel the running init, then remove everything installed
+func (lc *Lifecycle) Deprovision(serial string) (report *DeprovisionReport, err error) {
+	lc.health.Stop(serial)
+	done := make(chan bool)
+	lc.stopRetry(serial)
+	lc.workers.Offline(serial, func() {
+		defer close(done)
+		device := adb.Device(goadb.DeviceWithSerial(serial))
+		pd, er := newProvisionDevice(context.Background(), device, lc.ServerAddr)
+		if er != nil {
+			err = er
+			return
+		}
+		report = deprovisionDevice(pd)
+		if d, ok := dm.Modify(serial, func(d *ADevice) {
+			d.State = DEVICE_DEPROVISIONED
+			d.Udid = ""
+			d.AgentPort = 0
+			d.Health = nil
+		}); ok {
+			lc.report(d)
+		}
+	})
+	<-done
+	return
+}
+
+// Unavailable is called when device is still connected, but can not be used (unauthorized, recovery etc.)
+// Provision starts again when it came online
+func (lc *Lifecycle) Unavailable(serial string, state string) {
+	lc.health.Stop(serial)
+	lc.stopRetry(serial)
+	lc.workers.Offline(serial, func() {
+		dm.Update(serial, func(d *ADevice) {
+			d.Attempts = 0
+			d.NextRetryAt = nil
+			d.Udid = ""
+			d.AgentPort = 0
+		})
+		lc.setState(serial, state, nil)
+	})
+}
+
+// initDevice run provision steps, and schedule a retry on failure
+func (lc *Lifecycle) initDevice(ctx context.Context, serial string) {
+	d, ok := dm.Modify(serial, func(d *ADevice) {
+		d.State = DEVICE_INITIALIZING
+		d.Attempts++
+		d.NextRetryAt = nil
+		if d.retryTimer != nil {
+			d.retryTimer.Stop()
+			d.retryTimer = nil
+		}
+	})
+	if !ok {
+		return
+	}
+	lc.report(d)
+
+	metricInitAttempts.Inc()
+	transcripts.Start(serial, d.Attempts)
+	err := lc.provision(ctx, serial)
+	transcripts.Finish(serial, err)
+	if err == nil {
+		d, _ = dm.Modify(serial, func(d *ADevice) {
+			d.LastError = ""
+			d.Attempts = 0
+		})
+		if d.Capabilities.Full() {
+			lc.changeState(serial, DEVICE_READY, nil)
+		} else {
+			lc.changeState(serial, DEVICE_DEGRADED, nil)
+		}
+		log.Println("Success init", strconv.Quote(serial))
+		lc.health.Watch(ctx, serial, func(ctx context.Context) {
+			lc.workers.Enqueue(serial, ctx, "health", func(ctx context.Context) {
+				lc.checkHealth(ctx, serial)
+			})
+		})
+		return
+	}
+	if ctx.Err() != nil {
+		log.Printf("Init canceled: %s", serial)
+		return
+	}
+	log.Printf("Init error: %v", errors.Wrap(err, serial))
+	metricInitFailures.Inc()
+
+	backoff := retryBackoff(d.Attempts)
+	nextRetryAt := time.Now().Add(backoff)
+	timer := time.AfterFunc(backoff, func() {
+		lc.workers.Enqueue(serial, ctx, "init", func(ctx context.Context) {
+			lc.initDevice(ctx, serial)
+		})
+	})
+	if _, ok = dm.Modify(serial, func(d *ADevice) {
+		if d.retryTimer != nil {
+			d.retryTimer.Stop()
+		}
+		d.retryTimer = timer
+		d.NextRetryAt = &nextRetryAt
+	}); !ok {
+		timer.Stop()
+		return
+	}
+	lc.changeState(serial, DEVICE_FAILED, err)
+	log.Printf("%s retry init after %v", serial, backoff)
+}
+
+func (lc *Lifecycle) provision(ctx context.Context, serial string) error {
+	device := adb.Device(goadb.DeviceWithSerial(serial))
+	log.Println(serial, "Init device")
+	pd, err := initEverything(ctx, device, lc.ServerAddr)
+	if pd != nil && pd.Preflight != nil {
+		dm.Modify(serial, func(d *ADevice) { d.Preflight = pd.Preflight })
+	}
+	if err != nil {
+		return err
+	}
+	startService(device)
+	// start identify
+	runCommand(device, "am", "start", "-n", "com.github.uiautomator/.IdentifyActivity",
+		"-e", "theme", "black")
+
+	udid, forwardedPort, err := deviceUdid(device)
+	if err != nil {
+		return errors.Wrap(err, "get udid")
+	}
+	devInfo, err := device.DeviceInfo()
+	if err != nil {
+		return errors.Wrap(err, "get device info")
+	}
+
+	log.Println(serial, "UDID", udid)
+	log.Println(serial, "7912 forward to", forwardedPort)
+	capabilities := pd.Capabilities
+	capabilities.Uiautomator = uiautomatorInstalled(device)
+	dm.Modify(serial, func(d *ADevice) {
+		d.Capabilities = capabilities
+		d.PolicyDrift = pd.PolicyDrift
+		d.Model = devInfo.Model
+		d.Product = devInfo.Product
+		d.Udid = udid
+		d.AgentPort = forwardedPort
+	})
+	return nil
+}
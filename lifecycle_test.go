@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:  10 * time.Second,
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		6:  5 * time.Minute,
+		20: 5 * time.Minute,
+	}
+	for attempts, expect := range tests {
+		if got := retryBackoff(attempts); got != expect {
+			t.Errorf("retryBackoff(%d) expect %v, got %v", attempts, expect, got)
+		}
+	}
+}
+
+func TestDeviceStateHint(t *testing.T) {
+	states := []string{
+		ADB_STATE_DEVICE, ADB_STATE_DISCONNECTED, ADB_STATE_OFFLINE, ADB_STATE_UNAUTHORIZED,
+		ADB_STATE_RECOVERY, ADB_STATE_SIDELOAD, ADB_STATE_BOOTLOADER, ADB_STATE_AUTHORIZING, ADB_STATE_CONNECTING,
+		"no permissions (user in plugdev group; are your udev rules wrong?)", "host", "rescue",
+	}
+	for _, state := range states {
+		s := deviceState(state)
+		if state == ADB_STATE_DEVICE {
+			if unavailable(s) {
+				t.Errorf("online device should be available")
+			}
+			continue
+		}
+		if stateHints[s] == "" {
+			t.Errorf("no hint for adb state %q", state)
+		}
+	}
+	if s := deviceState("no permissions; see [http://developer.android.com/tools/device.html]"); s != DEVICE_NO_PERMISSIONS {
+		t.Errorf("expect %s, got %s", DEVICE_NO_PERMISSIONS, s)
+	}
+}
+
+func TestStopRetry(t *testing.T) {
+	fired := make(chan bool, 1)
+	dm.Update("retry-serial", func(d *ADevice) {
+		d.retryTimer = time.AfterFunc(50*time.Millisecond, func() { fired <- true })
+		next := time.Now().Add(50 * time.Millisecond)
+		d.NextRetryAt = &next
+	})
+	lc := &Lifecycle{}
+	lc.stopRetry("retry-serial")
+	select {
+	case <-fired:
+		t.Fatal("retry should be stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if d, _ := dm.Get("retry-serial"); d.retryTimer != nil || d.NextRetryAt != nil {
+		t.Errorf("retry should be cleared")
+	}
+}
+
+func TestStopRetryRemovedDevice(t *testing.T) {
+	lc := &Lifecycle{}
+	lc.stopRetry("removed-serial")
+	lc.changeState("removed-serial", DEVICE_FAILED, nil)
+	if _, ok := dm.Get("removed-serial"); ok {
+		t.Error("removed device should not be added back")
+	}
+}
+
+func TestReportNotBlock(t *testing.T) {
+	release := make(chan bool)
+	var mu sync.Mutex
+	posted := make([]string, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, string(body))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	lc := &Lifecycle{heart: NewHeartbeatClient(ts.URL, 7912)}
+	start := time.Now()
+	for _, state := range []string{DEVICE_DETECTED, DEVICE_INITIALIZING, DEVICE_FAILED, DEVICE_READY} {
+		lc.report(ADevice{Serial: "slow-server", State: state})
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("report should not wait for atx-server, took %v", time.Since(start))
+	}
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		got := append([]string{}, posted...)
+		mu.Unlock()
+		if len(got) > 0 && strings.Contains(got[len(got)-1], DEVICE_READY) {
+			// the one being sent, then only the latest of the rest
+			if len(got) > 2 {
+				t.Errorf("states waiting should be merged, got %v", got)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect the latest state sent, got %v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckerStop(t *testing.T) {
+	hc := NewHealthChecker(10 * time.Millisecond)
+	checked := make(chan bool, 10)
+	hc.Watch(context.Background(), "stop-serial", func(ctx context.Context) { checked <- true })
+	<-checked
+	hc.Stop("stop-serial")
+	if len(hc.watching) != 0 {
+		t.Errorf("watching should be removed, got %d", len(hc.watching))
+	}
+	time.Sleep(30 * time.Millisecond)
+	for len(checked) > 0 {
+		<-checked
+	}
+	select {
+	case <-checked:
+		t.Error("device should not be checked after stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
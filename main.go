@@ -1,21 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
-	"github.com/Masterminds/semver"
 	"github.com/alecthomas/kingpin"
 	"github.com/cavaliercoder/grab"
 	"github.com/franela/goreq"
-	"github.com/mholt/archiver"
 	"github.com/phayes/freeport"
 	"github.com/pkg/errors"
 	"github.com/qiniu/log"
@@ -25,9 +26,6 @@ import (
 
 var adb *goadb.Adb
 var resourcesDir string
-var stfBinariesDir string
-var apkVersionConstraint *semver.Constraints
-var versions Versions // contains apk version and atx-agent version
 
 func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile | log.Llevel)
@@ -41,7 +39,7 @@ func init() {
 
 }
 
-// Nubia can only work in /data/data/com.android.shell
+// atx-agent of Nubia is in /data/data/com.android.shell, see quirks.go
 // Others works in both directory
 const (
 	PATHENV       = "PATH=$PATH:/data/local/tmp:/data/data/com.android.shell"
@@ -49,220 +47,313 @@ const (
 )
 
 var (
-	AGENT_VERSION  = "0.5.1"
-	RECORD_VERSION = "1.3"
-	APK_VERSION    = "1.1.7"
-	SKIP_DEV       = false
+	SKIP_DEV = false
 )
 
 type ATXKeeper struct {
-	ServerAddr    string
-	SkipDev       bool
-	APKVersion    string
-	AgentVersion  string
-	RecordVersion string
+	ServerAddr      string
+	SkipDev         bool
+	Agent           *Component
+	Uiautomator     *Component
+	UiautomatorTest *Component
+	Recorder        *Component
+
+	ctx        context.Context
+	device     *goadb.Device
+	agentArchs []string
+	quirk      Quirk
+	setupOnce  sync.Once
+	untouched  map[string]bool // components pinned to skip
+}
 
-	device *goadb.Device
+// newATXKeeper resolve component versions from manifest and pins for this device
+func newATXKeeper(ctx context.Context, device *goadb.Device, serial string, props map[string]string, serverAddr string) *ATXKeeper {
+	k := &ATXKeeper{
+		ServerAddr:      serverAddr,
+		SkipDev:         SKIP_DEV,
+		Agent:           manifest.Resolve("atx-agent", props),
+		Uiautomator:     manifest.Resolve("app-uiautomator", props),
+		UiautomatorTest: manifest.Resolve("app-uiautomator-test", props),
+		Recorder:        manifest.Resolve("recorder", props),
+		ctx:             ctx,
+		device:          device,
+		agentArchs:      agentArchs(props),
+		quirk:           resolveQuirk(props),
+		untouched:       make(map[string]bool),
+	}
+	if k.quirk.Name != "" {
+		log.Infof("use quirk %s", k.quirk.Name)
+	}
+	k.Agent.DevicePath = k.quirk.agentPath(k.Agent.DevicePath)
+	if version, ok := rollouts.AgentVersion(serial); ok {
+		k.Agent.Version = version
+		k.Agent.Checksum = ""
+		k.Agent.Constraint = ""
+	}
+	for _, c := range []*Component{k.Agent, k.Uiautomator, k.UiautomatorTest, k.Recorder} {
+		if pins.Apply(serial, c) {
+			k.untouched[c.Name] = true
+		}
+	}
+	return k
+}
+
+// pinnedSkip return a plan item if component is pinned to skip
+func (k *ATXKeeper) pinnedSkip(step string, c *Component) (item PlanItem, ok bool) {
+	if !k.untouched[c.Name] {
+		return
+	}
+	return PlanItem{Step: step, Component: c.Name, Action: PLAN_SKIP, Reason: "pinned, not touched"}, true
+}
+
+// setup run setup commands of vendor quirk once
+func (k *ATXKeeper) setup() {
+	k.setupOnce.Do(func() {
+		k.quirk.RunSetup(k.device)
+	})
 }
 
 // processAgent install /data/local/tmp/atx-agent
 func (k *ATXKeeper) processAgent() error {
 	if !k.shouldUpdateAgent() {
-		log.Infof("SKIP, atx-agent is ok, version %s", k.AgentVersion)
+		log.Infof("SKIP, atx-agent is ok, version %s", k.Agent.Version)
 		return nil
 	}
 
-	agentReleaseURL := FormatString(GITHUB_MIRROR+"/openatx/atx-agent/releases/download/${AGENT_VERSION}/atx-agent_${AGENT_VERSION}_linux_armv6.tar.gz", map[string]string{
-		"AGENT_VERSION": AGENT_VERSION,
-	})
-	log.Infof("latest agent version %s", k.AgentVersion)
-	log.Println("download from", agentReleaseURL)
-	dstPath := resourcesDir + fmt.Sprintf("/atx-agent-%s.tar.gz", AGENT_VERSION)
-	cached, err := httpDownload(dstPath, agentReleaseURL)
+	log.Infof("latest agent version %s", k.Agent.Version)
+	return k.installAgent()
+}
+
+// installAgent push atx-agent of k.Agent.Version and restart it
+func (k *ATXKeeper) installAgent() error {
+	k.setup()
+	atxAgentPath, err := k.fetchAgent()
 	if err != nil {
 		return err
 	}
-	if cached {
-		log.Info("Use cached resource")
-	}
-	err = os.RemoveAll(resourcesDir+"/atx-agent-armv6")
-	if err != nil{
-		log.Infof("clear atx-agent-armv6 directory", err)
-	}
-	err = archiver.DefaultTarGz.Unarchive(dstPath, resourcesDir+"/atx-agent-armv6")
-	if err != nil{
-		return errors.Wrap(err, "unzip files")
-	}
-
-	atxAgentPath := filepath.Join(resourcesDir, "atx-agent-armv6/atx-agent")
-	if err := writeFileToDevice(k.device, atxAgentPath, "/data/local/tmp/atx-agent", 0755); err != nil {
+	if err := writeFileToDeviceContext(k.ctx, k.device, atxAgentPath, k.Agent.DevicePath, 0755); err != nil {
 		return errors.Wrap(err, "atx-agent")
 	}
-	_, err = k.device.RunCommand(PATHENV, "atx-agent", "server", "--stop")
-	if err != nil{
+	return k.restartAgent()
+}
+
+func (k *ATXKeeper) restartAgent() error {
+	_, err := runCommand(k.device, PATHENV, "atx-agent", "server", "--stop")
+	if err != nil {
 		return errors.Wrap(err, "stop atx-agent")
 	}
 	args := []string{"atx-agent", "server", "-d", "--nouia"}
 	if k.ServerAddr != "" {
 		args = append(args, "-t", k.ServerAddr)
 	}
-	output, err := k.device.RunCommand(PATHENV, args...)
+	output, err := runCommand(k.device, PATHENV, args...)
 	output = strings.TrimSpace(output)
 	if err != nil {
 		return errors.Wrap(err, "start atx-agent")
 	}
 
-	output, _ = k.device.RunCommand(PATHENV, "atx-agent", "version")
+	output, _ = runCommand(k.device, PATHENV, "atx-agent", "version")
 	log.Infof("new atx-agent version %s", output)
 	serial, _ := k.device.Serial()
 	fmt.Println(serial, output)
 	return nil
 }
 
+// fetchAgent download atx-agent built for device abi, try the next arch if not available
+func (k *ATXKeeper) fetchAgent() (localPath string, err error) {
+	for _, arch := range k.agentArchs {
+		if k.ctx.Err() != nil {
+			return "", k.ctx.Err()
+		}
+		k.Agent.Arch = arch
+		localPath, err = k.Agent.Fetch()
+		if err == nil {
+			log.Infof("use atx-agent %s build", arch)
+			return
+		}
+		log.Warnf("atx-agent %s build not available: %v", arch, err)
+	}
+	return "", errors.Wrap(err, "no atx-agent build available for "+strings.Join(k.agentArchs, ","))
+}
+
 func (k *ATXKeeper) shouldUpdateAgent() bool {
-	forwardedPort, err := k.device.ForwardToFreePort(goadb.ForwardSpec{
-		Protocol:   "tcp",
-		PortOrName: "7912",
-	})
+	item := k.planAgent()
+	if item.Action == PLAN_SKIP {
+		return false
+	}
+	log.Infof("%s atx-agent, %s", item.Action, item.Reason)
+	return true
+}
+
+// planAgent check atx-agent running in device, server addr is not checked if empty
+func (k *ATXKeeper) planAgent() PlanItem {
+	if item, ok := k.pinnedSkip("atx-agent", k.Agent); ok {
+		return item
+	}
+	item := PlanItem{Step: "atx-agent", Component: "atx-agent", Desired: k.Agent.Version, Action: PLAN_UPGRADE}
+	if _, err := k.device.Stat(k.Agent.DevicePath); err != nil {
+		item.Action = PLAN_INSTALL
+		item.Reason = k.Agent.DevicePath + " not found"
+		return item
+	}
+	curVersion, _ := runCommand(k.device, PATHENV, "atx-agent", "version")
+	item.Current = strings.TrimSpace(curVersion)
+
+	// plan must leave the device as it was
+	forwardedPort, release, err := forwardAgent(k.device)
 	if err != nil {
-		return true
+		item.Reason = "forward 7912: " + err.Error()
+		return item
 	}
+	defer release()
 	var v struct {
 		Udid      string `json:"udid"`
 		ServerURL string `json:"serverURL"`
 	}
 	res, err := retryGet(fmt.Sprintf("http://127.0.0.1:%d/info", forwardedPort))
 	if err != nil {
-		log.Infof("atx-agent /info not responding")
-		return true
+		item.Reason = "atx-agent /info not responding"
+		return item
 	}
 	defer res.Body.Close()
 	if err = res.Body.FromJsonTo(&v); err != nil {
-		return true
+		item.Reason = "atx-agent /info: " + err.Error()
+		return item
 	}
-	if v.ServerURL != "http://"+k.ServerAddr {
-		log.Infof("atx-agent server addr changed, '%s' -> 'http://%s'", v.ServerURL, k.ServerAddr)
-		return true
+	if k.ServerAddr != "" && v.ServerURL != "http://"+k.ServerAddr {
+		item.Reason = fmt.Sprintf("server addr changed, '%s' -> 'http://%s'", v.ServerURL, k.ServerAddr)
+		return item
 	}
 	// check version
-	curVersion, _ := k.device.RunCommand(PATHENV, "atx-agent", "version")
-	curVersion = strings.TrimSpace(curVersion)
-	if curVersion == "dev" && k.SkipDev {
-		log.Infof("SKIP, atx-agent version %s, skip update", strconv.Quote(curVersion))
-		return false
+	if item.Current == "dev" && k.SkipDev {
+		item.Action = PLAN_SKIP
+		item.Reason = fmt.Sprintf("version %s, skip update", strconv.Quote(item.Current))
+		return item
 	}
-	if curVersion != k.AgentVersion {
-		log.Infof("atx-agent version outdated, %s -> %s", curVersion, k.AgentVersion)
-		return true
+	if ok, reason := k.Agent.Accepts(item.Current); !ok {
+		item.Reason = reason
+		return item
 	}
-	return false
+	item.Action = PLAN_SKIP
+	item.Reason = "up to date"
+	if item.Current != k.Agent.Version {
+		item.Reason = fmt.Sprintf("version %s in range %s", item.Current, k.Agent.VersionRange())
+	}
+	return item
 }
 
 // 2 apks
 func (k *ATXKeeper) processUiautomator() error {
 	if !k.shouldUpdateUiautomator() {
-		log.Infof("SKIP, uiautomator-[test].apk %s already installed", k.APKVersion)
+		log.Infof("SKIP, uiautomator-[test].apk %s already installed", k.Uiautomator.Version)
 		return nil
 	}
 
-	apkReleaseBaseURL := FormatString(GITHUB_MIRROR+"/openatx/android-uiautomator-server/releases/download/${APK_VERSION}/", map[string]string{
-		"APK_VERSION": k.APKVersion,
-	})
-	suffix := fmt.Sprintf("-%s.apk", k.APKVersion)
-	apk1Dest := resourcesDir + "/app-uiautomator" + suffix
-	apk2Dest := resourcesDir + "/app-uiautomator-test" + suffix
-	var err error
-	_, err = httpDownload(apk1Dest, apkReleaseBaseURL+"app-uiautomator.apk")
-	if err != nil {
-		return err
-	}
-	_, err = httpDownload(apk2Dest, apkReleaseBaseURL+"app-uiautomator-test.apk")
-	if err != nil {
-		return err
-	}
-	log.Infof("install app-uiautomator.apk version %s", k.APKVersion)
-	err = k.forceInstallAPK(apk1Dest)
-	if err != nil {
-
+	log.Infof("install app-uiautomator.apk version %s", k.Uiautomator.Version)
+	if err := k.installComponent(k.Uiautomator); err != nil {
 		return err
 	}
-	log.Infof("install app-uiautomator-test.apk version %s", k.APKVersion)
-	err = k.forceInstallAPK(apk2Dest)
-	if err != nil {
-		return err
-	}
-	return nil
+	log.Infof("install app-uiautomator-test.apk version %s", k.UiautomatorTest.Version)
+	return k.installComponent(k.UiautomatorTest)
 }
 
 func (k *ATXKeeper) processRecordAPK() error {
 	if !k.shouldUpdateRecordAPK() {
-		log.Infof("SKIP, record apk %s already installed", k.RecordVersion)
+		log.Infof("SKIP, record apk %s already installed", k.Recorder.Version)
 		return nil
 	}
-	log.Infof("install record apk, version %s", k.RecordVersion)
-	recordReleaseURL := GITHUB_MIRROR + "/openatx/android-uiautomator-server/releases/download/1.1.5/com.easetest.recorder_" + k.RecordVersion + ".apk"
-	recordDst := resourcesDir + FormatString("/com.easetest.recorder-${RECORD_VERSION}.apk", map[string]string{
-		"RECORD_VERSION": k.RecordVersion,
-	})
-	_, err := httpDownload(recordDst, recordReleaseURL)
-	if err != nil {
-		return err
-	}
-	return k.forceInstallAPK(recordDst)
+	log.Infof("install record apk, version %s", k.Recorder.Version)
+	return k.installComponent(k.Recorder)
 }
 
 func (k *ATXKeeper) shouldUpdateRecordAPK() bool {
-	info, err := k.device.StatPackage("com.easetest.recorder")
-	if err != nil {
-		log.Debugf("package com.easetest.recorder not installed")
-		return true
+	item := k.planRecordAPK()
+	if item.Action == PLAN_SKIP {
+		return false
 	}
-	if info.Version.Name != k.RecordVersion {
-		log.Infof("expect record apk version %s, but got %s",
-			strconv.Quote(k.RecordVersion), strconv.Quote(info.Version.Name))
-		return true
+	log.Infof("%s record apk, %s", item.Action, item.Reason)
+	return true
+}
+
+func (k *ATXKeeper) planRecordAPK() PlanItem {
+	if item, ok := k.pinnedSkip("record-apk", k.Recorder); ok {
+		return item
 	}
-	return false
+	return planPackage(k.device, "record-apk", k.Recorder)
 }
 
 func (k *ATXKeeper) shouldUpdateUiautomator() bool {
-	info, err := k.device.StatPackage("com.github.uiautomator")
-	if err != nil {
-		log.Debugf("package com.github.uiautomator not installed")
-		return true
-	}
-	if info.Version.Name != k.APKVersion {
-		log.Infof("expect uiautomator apk version %s, but got %s",
-			strconv.Quote(k.APKVersion), strconv.Quote(info.Version.Name))
-		return true
+	for _, item := range k.planUiautomator() {
+		if item.Action != PLAN_SKIP {
+			log.Infof("%s %s, %s", item.Action, item.Component, item.Reason)
+			return true
+		}
 	}
+	return false
+}
+
+// planUiautomator check both apks, they are always installed together
+func (k *ATXKeeper) planUiautomator() []PlanItem {
+	if item, ok := k.pinnedSkip("uiautomator", k.Uiautomator); ok {
+		test := item
+		test.Component = k.UiautomatorTest.Name
+		return []PlanItem{item, test}
+	}
+	app := planPackage(k.device, "uiautomator", k.Uiautomator)
+	test := planPackage(k.device, "uiautomator", k.UiautomatorTest)
+	// version of test apk is not checked
+	if test.Action == PLAN_UPGRADE {
+		test.Action = PLAN_SKIP
+		test.Reason = "installed"
+	}
+	if app.Action != PLAN_SKIP && test.Action == PLAN_SKIP {
+		test.Action = PLAN_UPGRADE
+		test.Reason = "reinstalled with " + app.Component
+	}
+	if test.Action != PLAN_SKIP && app.Action == PLAN_SKIP {
+		app.Action = PLAN_UPGRADE
+		app.Reason = "reinstalled with " + test.Component
+	}
+	return []PlanItem{app, test}
+}
 
-	// test package
-	_, err = k.device.StatPackage("com.github.uiautomator.test")
+// installComponent download component and install it according to install mode
+func (k *ATXKeeper) installComponent(c *Component) error {
+	localPath, err := c.Fetch()
 	if err != nil {
-		log.Infof("package com.github.uiautomator.test not installed")
-		return true
+		return err
 	}
-	return false
+	switch c.Install {
+	case INSTALL_APK:
+		return k.forceInstallAPK(localPath, c.DevicePath)
+	case INSTALL_BINARY, INSTALL_TARGZ:
+		return writeFileToDeviceContext(k.ctx, k.device, localPath, c.DevicePath, 0755)
+	}
+	return nil
 }
 
-func (k *ATXKeeper) forceInstallAPK(localPath string) error {
+func (k *ATXKeeper) forceInstallAPK(localPath string, deviceDir string) error {
 	pkg, err := apk.OpenFile(localPath)
 	if err != nil {
 		return err
 	}
 	packageName := pkg.PackageName()
-	k.device.RunCommand("pm", "uninstall", packageName)
-	return k.installAPK(localPath)
+	runCommand(k.device, "pm", "uninstall", packageName)
+	return k.installAPK(localPath, deviceDir)
 }
 
-func (k *ATXKeeper) installAPK(localPath string) error {
-	dstPath := "/sdcard/tmp/" + filepath.Base(localPath)
-	if err := writeFileToDevice(k.device, localPath, dstPath, 0644); err != nil {
+func (k *ATXKeeper) installAPK(localPath string, deviceDir string) error {
+	// the default dir is replaced by quirk, other dirs set in manifest are kept
+	if deviceDir == "" || path.Clean(deviceDir) == defaultTmpDir {
+		deviceDir = k.quirk.TmpDir
+	}
+	k.setup()
+	dstPath := path.Join(deviceDir, filepath.Base(localPath))
+	if err := writeFileToDeviceContext(k.ctx, k.device, localPath, dstPath, 0644); err != nil {
 		return err
 	}
-	defer k.device.RunCommand("rm", dstPath)
-	output, err := k.device.RunCommand("pm", "install", "-r", "-t", dstPath)
+	defer runCommand(k.device, "rm", dstPath)
+	output, err := runCommand(k.device, "pm", k.quirk.InstallCommand(dstPath)...)
 	if err != nil {
 		return err
 	}
@@ -272,70 +363,28 @@ func (k *ATXKeeper) installAPK(localPath string) error {
 	return nil
 }
 
-func initEverything(device *goadb.Device, serverAddr string) error {
-	props, err := device.Properties()
+func initEverything(ctx context.Context, device *goadb.Device, serverAddr string) (*ProvisionDevice, error) {
+	pd, err := newProvisionDevice(ctx, device, serverAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	sdk := props["ro.build.version.sdk"]
-	abi := props["ro.product.cpu.abi"]
-	pre := props["ro.build.version.preview_sdk"]
-	log.Printf("product model: %s\n", props["ro.product.model"])
-
-	if pre != "" && pre != "0" {
-		sdk += pre
-	}
-	log.Println("Process minicap and minitouch")
-	if err := initSTFMiniTools(device, abi, sdk); err != nil {
-		return errors.Wrap(err, "mini(cap|touch)")
-	}
-
-	log.Println("Process atx-agent")
-	ak := &ATXKeeper{
-		AgentVersion:  AGENT_VERSION,
-		RecordVersion: RECORD_VERSION,
-		APKVersion:    APK_VERSION,
-		ServerAddr:    serverAddr,
-		SkipDev:       SKIP_DEV,
-		device:        device,
-	}
-	if err := ak.processAgent(); err != nil {
-		log.Warnf("install atx-agent failed: %v", err)
-		return err
-	}
-	if err := ak.processUiautomator(); err != nil {
-		log.Warnf("install uiautomator failed")
-		return err
-	}
-	// if err := ak.processRecordAPK(); err != nil {
-	// 	log.Warnf("install record apk failed")
-	// 	return err
-	// }
-	return nil
+	log.Printf("product model: %s\n", pd.Props["ro.product.model"])
+	cleanPartialFiles(device, pd.Keeper.quirk)
+	_, err = provisionSteps.Run(pd)
+	return pd, err
 }
 
-func initMiniTouch(device *goadb.Device, abi string) error {
-	srcPath := fmt.Sprintf(stfBinariesDir+"/minitouch-prebuilt/prebuilt/%s/bin/minitouch", abi)
-	return writeFileToDevice(device, srcPath, "/data/local/tmp/minitouch", 0755)
-}
-
-func initSTFMiniTools(device *goadb.Device, abi, sdk string) error {
-	soSrcPath := fmt.Sprintf(stfBinariesDir+"/minicap-prebuilt/prebuilt/%s/lib/android-%s/minicap.so", abi, sdk)
-	err := writeFileToDevice(device, soSrcPath, "/data/local/tmp/minicap.so", 0644)
-	if err != nil {
-		return err
-	}
-	binSrcPath := fmt.Sprintf(stfBinariesDir+"/minicap-prebuilt/prebuilt/%s/bin/minicap", abi)
-	err = writeFileToDevice(device, binSrcPath, "/data/local/tmp/minicap", 0755)
-	if err != nil {
-		return err
+func uiautomatorInstalled(device *goadb.Device) bool {
+	for _, pkg := range []string{"com.github.uiautomator", "com.github.uiautomator.test"} {
+		if _, err := device.StatPackage(pkg); err != nil {
+			return false
+		}
 	}
-	touchSrcPath := fmt.Sprintf(stfBinariesDir+"/minitouch-prebuilt/prebuilt/%s/bin/minitouch", abi)
-	return writeFileToDevice(device, touchSrcPath, "/data/local/tmp/minitouch", 0755)
+	return true
 }
 
 func startService(device *goadb.Device) (err error) {
-	_, err = device.RunCommand("am", "startservice", "-n", "com.github.uiautomator/.Service")
+	_, err = runCommand(device, "am", "startservice", "-n", "com.github.uiautomator/.Service")
 	return err
 }
 
@@ -355,6 +404,28 @@ func retryGet(url string) (res *goreq.Response, err error) {
 	return nil, errors.New("unable get url: " + url)
 }
 
+// forwardAgent forward atx-agent port 7912 to a local port, the existing forward is reused
+// release removes the forward only if it is created here, so probes leave no forward behind
+func forwardAgent(device *goadb.Device) (port int, release func(), err error) {
+	remote := goadb.ForwardSpec{Protocol: goadb.FProtocolTcp, PortOrName: "7912"}
+	fws, err := device.ForwardList()
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, fw := range fws {
+		if fw.Remote == remote {
+			port, err = fw.Local.Port()
+			return port, func() {}, err
+		}
+	}
+	if port, err = device.ForwardToFreePort(remote); err != nil {
+		return 0, nil, err
+	}
+	return port, func() {
+		device.ForwardRemove(goadb.ForwardSpec{Protocol: goadb.FProtocolTcp, PortOrName: strconv.Itoa(port)})
+	}, nil
+}
+
 func deviceUdid(device *goadb.Device) (udid string, port int, err error) {
 	forwardedPort, err := device.ForwardToFreePort(goadb.ForwardSpec{
 		Protocol:   "tcp",
@@ -397,6 +468,38 @@ func (dm *DeviceManager) Add(info ADevice) {
 	dm.devices[info.Serial] = info
 }
 
+// Update modify device info in place, device is created if not exists
+func (dm *DeviceManager) Update(serial string, fn func(d *ADevice)) ADevice {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	if dm.devices == nil {
+		dm.devices = make(map[string]ADevice)
+	}
+	d, ok := dm.devices[serial]
+	if !ok {
+		d = ADevice{Serial: serial}
+	}
+	fn(&d)
+	d.UpdatedAt = time.Now()
+	dm.devices[serial] = d
+	return d
+}
+
+// Modify is Update without creating, false is returned if device not exists
+// Used by tasks may run after the device removed, eg: retry and health check
+func (dm *DeviceManager) Modify(serial string, fn func(d *ADevice)) (ADevice, bool) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	d, ok := dm.devices[serial]
+	if !ok {
+		return d, false
+	}
+	fn(&d)
+	d.UpdatedAt = time.Now()
+	dm.devices[serial] = d
+	return d, true
+}
+
 func (dm *DeviceManager) Remove(serial string) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
@@ -415,63 +518,46 @@ func (dm *DeviceManager) All() []ADevice {
 
 var dm = &DeviceManager{}
 
-func watchAndInit(serverAddr string, heart *HeartbeatClient) {
-	watcher := adb.NewDeviceWatcher()
-	for event := range watcher.C() {
-		if event.CameOnline() {
-			log.Printf("Device %s came online", event.Serial)
-			device := adb.Device(goadb.DeviceWithSerial(event.Serial))
-			log.Println(event.Serial, "Init device")
-			if err := initEverything(device, serverAddr); err != nil {
-				log.Printf("Init error: %v", errors.Wrap(err, event.Serial))
-				continue
-			}
-			startService(device)
-			// start identify
-			device.RunCommand("am", "start", "-n", "com.github.uiautomator/.IdentifyActivity",
-				"-e", "theme", "black")
-
-			udid, forwardedPort, err := deviceUdid(device)
-			if err != nil {
-				log.Println(event.Serial, err)
-				continue
-			}
-			devInfo, err := device.DeviceInfo()
-			if err != nil {
-				log.Println(event.Serial, err)
-				continue
-			}
+// lifecycle is created in main, nil when not running as server
+var lifecycle *Lifecycle
+
+// recheckC is used to ask watchAndInit to init all connected devices again
+var recheckC = make(chan bool, 1)
 
-			log.Println(event.Serial, "UDID", udid)
-			log.Println(event.Serial, "7912 forward to", forwardedPort)
-			if heart != nil {
-				// device manager
-				dm.Add(ADevice{
-					Serial:    event.Serial,
-					Model:     devInfo.Model,
-					Product:   devInfo.Product,
-					Udid:      udid,
-					AgentPort: forwardedPort,
-				})
-				heart.AddData(event.Serial, map[string]interface{}{
-					"udid":                  udid,
-					"status":                "online",
-					"providerForwardedPort": forwardedPort,
-				})
+func requestRecheck() {
+	select {
+	case recheckC <- true:
+	default: // a recheck is already pending
+	}
+}
+
+func watchAndInit(lc *Lifecycle) {
+	eventC := watchDevices(adb)
+	for {
+		select {
+		case event := <-eventC:
+			state := deviceState(event.NewState)
+			switch {
+			case event.CameOnline():
+				log.Printf("Device %s came online", event.Serial)
+				lc.Online(event.Serial)
+			case event.NewState == ADB_STATE_DISCONNECTED:
+				log.Printf("Device %s went offline", event.Serial)
+				lc.Offline(event.Serial)
+			default:
+				log.Printf("Device %s is %s", event.Serial, state)
+				lc.Unavailable(event.Serial, state)
 			}
-			log.Println("Success init", strconv.Quote(event.Serial))
-		}
-		if event.WentOffline() {
-			log.Printf("Device %s went offline", event.Serial)
-			dm.Remove(event.Serial)
-			if heart != nil {
-				heart.Delete(event.Serial)
+		case <-recheckC:
+			for _, d := range dm.All() {
+				if unavailable(d.State) || d.State == DEVICE_DEPROVISIONED {
+					continue
+				}
+				log.Printf("Device %s recheck", d.Serial)
+				lc.Online(d.Serial)
 			}
 		}
 	}
-	if watcher.Err() != nil {
-		log.Fatal(watcher.Err())
-	}
 }
 
 // Documents: https://testerhome.com/topics/8121
@@ -517,28 +603,103 @@ esac
 	fmt.Print(pattern)
 }
 
-type Versions struct {
-	AgentVersion  string `json:"atx-agent"`
-	ApkVersion    string `json:"uiautomator-apk"`
-	RecordVersion string `json:"recorder-apk"`
-}
-
-func httpDownload(dst string, url string) (cached bool, err error) {
+// httpDownload save file to dst from the first source works, existing file is used as cache only if it matches sha256
+// Mismatched files are quarantined and downloaded again
+func httpDownload(dst string, sources []mirrorSource, sha256 string) (cached bool, err error) {
 	if _, err := os.Stat(dst); err == nil {
-		return true, nil
+		err = verifyFile(dst, sha256)
+		if err == nil {
+			reportCacheHit()
+			return true, nil
+		}
+		log.Warnf("cached file is broken: %v", err)
+		quarantine(dst)
+	}
+	errs := make([]string, 0, len(sources))
+	for _, src := range sources {
+		log.Println("download from", src.URL)
+		var written int64
+		written, err = downloadSource(dst, src, sha256)
+		src.report(written, err)
+		if err == nil {
+			if src.Mirror != "" {
+				log.Infof("%s served by %s", filepath.Base(dst), src.name())
+			}
+			return false, nil
+		}
+		log.Warnf("download %s: %v", src.URL, err)
+		errs = append(errs, err.Error())
 	}
-	resp, err := grab.Get(dst+".cached", url)
-	if err != nil {
-		return false, err
+	if len(errs) > 1 {
+		return false, errMirrors(errs)
 	}
-	log.Info("Download saved to", resp.Filename)
-	return false, os.Rename(dst+".cached", dst)
+	return false, err
 }
+
+// downloadSource download one url, retry once if sha256 mismatch
+func downloadSource(dst string, src mirrorSource, sha256 string) (written int64, err error) {
+	for i := 0; i < 2; i++ {
+		var req *grab.Request
+		req, err = grab.NewRequest(dst+".cached", src.URL)
+		if err != nil {
+			return written, err
+		}
+		timeout := src.Timeout
+		if timeout <= 0 {
+			timeout = defaultMirrorTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		resp := grab.DefaultClient.Do(req.WithContext(ctx))
+		err = resp.Err()
+		cancel()
+		written += resp.BytesComplete()
+		if err != nil {
+			return written, err
+		}
+		log.Info("Download saved to", resp.Filename)
+		err = verifyFile(resp.Filename, sha256)
+		if err == nil {
+			return written, os.Rename(dst+".cached", dst)
+		}
+		quarantine(resp.Filename)
+		if _, ok := err.(*ChecksumError); !ok {
+			return written, err
+		}
+	}
+	return written, err
+}
+
 func main() {
+	cmdServe := kingpin.Command("serve", "watch and init devices, this is the default command").Default()
+	cmdDeprovision := kingpin.Command("deprovision", "stop atx-agent, remove apks and binaries installed by u2init")
+	fDeprovisionSerial := cmdDeprovision.Flag("serial", "device serial").Required().String()
+	cmdPlan := kingpin.Command("plan", "show what would be installed or upgraded, devices are not changed")
+	fPlanSerials := cmdPlan.Flag("serial", "device serial, all connected devices if not specified").Strings()
+	cmdBundle := kingpin.Command("bundle", "pack resources for hosts without internet")
+	cmdBundleExport := cmdBundle.Command("export", "download every resource in manifest and pack them into one file")
+	fBundleOutput := cmdBundleExport.Flag("output", "bundle file").Short('o').
+		Default("u2init-bundle-" + time.Now().Format("20060102") + ".tar.gz").String()
+	cmdBundleImport := cmdBundle.Command("import", "unpack and verify bundle into resources dir")
+	fBundleInput := cmdBundleImport.Arg("file", "bundle file created by bundle export").Required().String()
+	cmdResources := kingpin.Command("resources", "manage files in resources dir")
+	cmdResourcesFetch := cmdResources.Command("fetch", "download every resource in manifest")
+	cmdResourcesVerify := cmdResources.Command("verify", "check sha256 of downloaded resources")
+	cmdResourcesList := cmdResources.Command("list", "show resources present or missing, by component and by abi")
+	cmdResourcesPrune := cmdResources.Command("prune", "remove versions no longer in manifest")
+	fPruneDryRun := cmdResourcesPrune.Flag("dry-run", "only print what would be removed").Bool()
+
 	fport := kingpin.Flag("port", "listen port, random free port if not specified").Short('p').Int()
-	fServerAddr := kingpin.Flag("server", "atx-server address, format must be ip:port or hostname").Short('s').Required().String()
+	fServerAddr := kingpin.Flag("server", "atx-server address, format must be ip:port or hostname").Short('s').String()
 	fInitd := kingpin.Flag("initd", "Generate /etc/init.d file (Debian only)").Bool()
 	fAgentVersion := kingpin.Flag("agent", "atx-agent version code, format must be like '0.5.1'").Short('a').String()
+	fSteps := kingpin.Flag("steps", "provision steps to run in order, comma separated, eg: minitools,atx-agent,uiautomator").String()
+	fSkipSteps := kingpin.Flag("skip-step", "provision step to skip, can be specified multiple times").Strings()
+	fConcurrency := kingpin.Flag("concurrency", "max number of devices init at the same time").Default("4").Int()
+	kingpin.Flag("health-interval", "interval of device health check").Default("30s").DurationVar(&healthChecker.Interval)
+	fManifest := kingpin.Flag("manifest", "json or yaml file which list components version, url and install mode").String()
+	fPeers := kingpin.Flag("peer", "another u2init (host:port) to get cached resources from, can be specified multiple times").Strings()
+	kingpin.Flag("peers-url", "url returns list of other u2init, refreshed every minute").StringVar(&peers.URL)
+	fMirrors := kingpin.Flag("mirror", "replace ${MIRROR} in urls of manifest, tried in order, can be specified multiple times").Strings()
 
 	execDir, err := os.Executable()
 	if err != nil {
@@ -547,13 +708,84 @@ func main() {
 	kingpin.Flag("resdir", "directory contains minicap, apk etc resources").
 		Default(filepath.Join(filepath.Dir(execDir), "resources")).StringVar(&resourcesDir)
 
+	kingpin.Flag("statedir", "directory to keep provision transcripts").
+		Default(filepath.Join(filepath.Dir(execDir), "state")).StringVar(&stateDir)
+	kingpin.Flag("history-keep", "number of provision transcripts kept for each device").Default("20").IntVar(&transcripts.Keep)
+	kingpin.Flag("history-max-age", "provision transcripts older than this are removed").Default("168h").DurationVar(&transcripts.MaxAge)
+
 	kingpin.CommandLine.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
-	if *fAgentVersion != ""{
-		AGENT_VERSION = *fAgentVersion
+	if *fManifest != "" {
+		m, err := loadManifest(*fManifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		useManifest(m)
+	}
+	peers.Set(*fPeers)
+	if len(*fMirrors) > 0 {
+		mirrors := make([]Mirror, 0, len(*fMirrors))
+		for _, u := range *fMirrors {
+			mirrors = append(mirrors, Mirror{URL: u})
+		}
+		if err := manifest.SetMirrors(mirrors); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *fAgentVersion != "" {
+		manifest.SetVersion("atx-agent", *fAgentVersion)
+	}
+	if err := pins.Load(filepath.Join(stateDir, "pins.json")); err != nil {
+		log.Fatal(err)
+	}
+	versionWatcher := NewVersionWatcher(*fServerAddr)
+	versionWatcher.AgentOverride = *fAgentVersion
+	versionWatcher.OnChange = func(v Versions) {
+		log.Println("Desired versions changed, recheck connected devices")
+		requestRecheck()
+	}
+	if *fSteps != "" {
+		if err := provisionSteps.SetOrder(strings.Split(*fSteps, ",")); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, name := range *fSkipSteps {
+		if err := provisionSteps.Disable(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch command {
+	case cmdDeprovision.FullCommand():
+		runDeprovision(*fDeprovisionSerial)
+		return
+	case cmdPlan.FullCommand():
+		runPlan(*fPlanSerials, *fServerAddr)
+		return
+	case cmdBundleExport.FullCommand():
+		runBundleExport(*fBundleOutput)
+		return
+	case cmdBundleImport.FullCommand():
+		runBundleImport(*fBundleInput)
+		return
+	case cmdResourcesFetch.FullCommand():
+		runResourcesFetch()
+		return
+	case cmdResourcesVerify.FullCommand():
+		runResourcesVerify()
+		return
+	case cmdResourcesList.FullCommand():
+		runResourcesList()
+		return
+	case cmdResourcesPrune.FullCommand():
+		runResourcesPrune(*fPruneDryRun)
+		return
+	case cmdServe.FullCommand():
+		if *fServerAddr == "" {
+			kingpin.Fatalf("required flag --server not provided")
+		}
 	}
-	stfBinariesDir = filepath.Join(resourcesDir, "stf-binaries-0.2/node_modules")
 
 	if *fInitd {
 		generateInitd(*fServerAddr)
@@ -585,18 +817,18 @@ func main() {
 		panic(err)
 	}
 
-	// FIXME(ssx): get apk version from server
-	apkVersionConstraint, err = semver.NewConstraint(">= 1.1.5")
-	if err != nil {
-		panic(err)
-	}
-
 	err = heart.Ping()
 	if err != nil {
 		log.Println("Warning", err)
 	}
 
+	if _, _, err := versionWatcher.Check(); err != nil {
+		log.Println("Warning, get versions from server:", err)
+	}
+
 	go heart.PingForever()
+	go peers.Watch(heart.ID, port)
+	go versionWatcher.Watch()
 	go func() {
 		log.Fatal(http.Serve(ln, nil))
 	}()
@@ -606,5 +838,64 @@ func main() {
 		log.Println(err)
 	}
 	log.Println("Watch and init, adb version", adbVersion)
-	watchAndInit(*fServerAddr, heart)
+	lifecycle = &Lifecycle{
+		ServerAddr: *fServerAddr,
+		heart:      heart,
+		workers:    NewDeviceWorkers(*fConcurrency),
+		health:     healthChecker,
+	}
+	watchAndInit(lifecycle)
+}
+
+func runDeprovision(serial string) {
+	device := adb.Device(goadb.DeviceWithSerial(serial))
+	pd, err := newProvisionDevice(context.Background(), device, "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	report := deprovisionDevice(pd)
+	for _, name := range report.Removed {
+		fmt.Println("removed", name)
+	}
+	for _, e := range report.Errors {
+		fmt.Println("error", e)
+	}
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runPlan(serials []string, serverAddr string) {
+	if len(serials) == 0 {
+		var err error
+		if serials, err = adb.ListDeviceSerials(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tSTEP\tCOMPONENT\tACTION\tVERSION\tREASON")
+	failed := false
+	for _, serial := range serials {
+		device := adb.Device(goadb.DeviceWithSerial(serial))
+		pd, err := newProvisionDevice(context.Background(), device, serverAddr)
+		if err == nil {
+			var plan *ProvisionPlan
+			if plan, err = planDevice(pd); err == nil {
+				for _, item := range plan.Items {
+					version := item.Desired
+					if item.Current != "" && item.Current != item.Desired {
+						version = item.Current + " -> " + item.Desired
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", serial, item.Step, item.Component, item.Action, version, item.Reason)
+				}
+				continue
+			}
+		}
+		failed = true
+		fmt.Fprintf(w, "%s\t\t\terror\t\t%v\n", serial, err)
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Component install modes
+const (
+	INSTALL_APK    = "apk"    // download and pm install
+	INSTALL_BINARY = "binary" // download and push to DevicePath
+	INSTALL_TARGZ  = "tar.gz" // download, extract and push the file named basename(DevicePath)
+	INSTALL_ZIP    = "zip"    // download and extract into resourcesDir, not pushed
+)
+
+// DeviceMatch use glob patterns, empty field matches everything
+type DeviceMatch struct {
+	Manufacturer string `json:"manufacturer,omitempty" yaml:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty" yaml:"model,omitempty"`
+	Sdk          string `json:"sdk,omitempty" yaml:"sdk,omitempty"`
+	Abi          string `json:"abi,omitempty" yaml:"abi,omitempty"`
+}
+
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return ok
+}
+
+func (m DeviceMatch) Match(props map[string]string) bool {
+	return globMatch(m.Manufacturer, props["ro.product.manufacturer"]) &&
+		globMatch(m.Model, props["ro.product.model"]) &&
+		globMatch(m.Sdk, props["ro.build.version.sdk"]) &&
+		globMatch(m.Abi, props["ro.product.cpu.abi"])
+}
+
+// ComponentOverride replace non-empty fields of Component when Match
+type ComponentOverride struct {
+	Match      DeviceMatch `json:"match" yaml:"match"`
+	Version    string      `json:"version,omitempty" yaml:"version,omitempty"`
+	URL        string      `json:"url,omitempty" yaml:"url,omitempty"`
+	Checksum   string      `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	DevicePath string      `json:"devicePath,omitempty" yaml:"devicePath,omitempty"`
+	Install    string      `json:"install,omitempty" yaml:"install,omitempty"`
+	Constraint string      `json:"constraint,omitempty" yaml:"constraint,omitempty"`
+
+	ChecksumURL string `json:"checksumUrl,omitempty" yaml:"checksumUrl,omitempty"`
+}
+
+// Component is a resource which will be downloaded and installed into devices
+// URL is a template, ${VERSION}, ${ARCH} and ${MIRROR} will be replaced
+// Version is the preferred one, installed when the version in device is out of Constraint (a semver range, eg: ">= ${VERSION}, < 2.0.0")
+type Component struct {
+	Name       string              `json:"name" yaml:"name"`
+	Version    string              `json:"version" yaml:"version"`
+	Constraint string              `json:"constraint,omitempty" yaml:"constraint,omitempty"` // empty means exactly Version
+	URL        string              `json:"url" yaml:"url"`
+	Checksum   string              `json:"checksum,omitempty" yaml:"checksum,omitempty"` // sha256, pinned
+	DevicePath string              `json:"devicePath,omitempty" yaml:"devicePath,omitempty"`
+	Install    string              `json:"install" yaml:"install"`
+	Package    string              `json:"package,omitempty" yaml:"package,omitempty"` // android package name, only for apk
+	Overrides  []ComponentOverride `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+
+	// ChecksumURL is a file in sha256sum format published alongside the release, used when Checksum is empty
+	ChecksumURL string `json:"checksumUrl,omitempty" yaml:"checksumUrl,omitempty"`
+
+	// Mirrors replace ${MIRROR} in URL and ChecksumURL, tried in order, the global ones are used if empty
+	Mirrors []Mirror `json:"mirrors,omitempty" yaml:"mirrors,omitempty"`
+
+	Arch string `json:"-" yaml:"-"` // set before Fetch when URL contains ${ARCH}
+}
+
+func (c *Component) apply(o ComponentOverride) {
+	if o.Version != "" {
+		c.Version = o.Version
+	}
+	if o.URL != "" {
+		c.URL = o.URL
+	}
+	if o.Checksum != "" {
+		c.Checksum = o.Checksum
+	}
+	if o.DevicePath != "" {
+		c.DevicePath = o.DevicePath
+	}
+	if o.Install != "" {
+		c.Install = o.Install
+	}
+	if o.ChecksumURL != "" {
+		c.ChecksumURL = o.ChecksumURL
+	}
+	if o.Constraint != "" {
+		c.Constraint = o.Constraint
+	}
+}
+
+func (c *Component) templateValues() map[string]string {
+	return map[string]string{
+		"VERSION": c.Version,
+		"ARCH":    c.Arch,
+		"MIRROR":  c.mirrors()[0].URL,
+	}
+}
+
+func (c *Component) mirrors() []Mirror {
+	if len(c.Mirrors) > 0 {
+		return c.Mirrors
+	}
+	return globalMirrors()
+}
+
+// sources return download urls of every mirror, the healthy ones first
+func (c *Component) sources() []mirrorSource {
+	return mirrorSources(c.URL, c.templateValues(), c.mirrors())
+}
+
+// VersionRange return Constraint with variables replaced, or Version if no constraint
+func (c *Component) VersionRange() string {
+	if c.Constraint == "" {
+		return c.Version
+	}
+	return FormatString(c.Constraint, c.templateValues())
+}
+
+// Accepts check whether the installed version need not be replaced
+func (c *Component) Accepts(installed string) (ok bool, reason string) {
+	if installed == "" {
+		return false, "version unknown"
+	}
+	if c.Constraint == "" {
+		if installed != c.Version {
+			return false, fmt.Sprintf("version outdated, %s -> %s", installed, c.Version)
+		}
+		return true, ""
+	}
+	constraint, err := semver.NewConstraint(c.VersionRange())
+	if err != nil {
+		return false, fmt.Sprintf("invalid constraint %s: %v", strconv.Quote(c.VersionRange()), err)
+	}
+	v, err := semver.NewVersion(installed)
+	if err != nil {
+		return false, fmt.Sprintf("version %s is not semver, -> %s", strconv.Quote(installed), c.Version)
+	}
+	if !constraint.Check(v) {
+		return false, fmt.Sprintf("version %s out of range %s, -> %s", installed, c.VersionRange(), c.Version)
+	}
+	return true, ""
+}
+
+// DownloadURL return URL with variables replaced
+func (c *Component) DownloadURL() string {
+	return FormatString(c.URL, c.templateValues())
+}
+
+// LocalPath is where the downloaded file saved, eg: resources/atx-agent-0.5.1-armv7.tar.gz
+func (c *Component) LocalPath() string {
+	ext := path.Ext(c.DownloadURL())
+	if strings.HasSuffix(c.DownloadURL(), ".tar.gz") {
+		ext = ".tar.gz"
+	}
+	return filepath.Join(resourcesDir, c.baseName()+ext)
+}
+
+// baseName is name of the file in resourcesDir without ext
+func (c *Component) baseName() string {
+	name := c.Name + "-" + c.Version
+	if c.Arch != "" {
+		name += "-" + c.Arch
+	}
+	return name
+}
+
+// ExpectedChecksum return the pinned checksum, or the one published in ChecksumURL
+// Empty string means the component is not verified
+func (c *Component) ExpectedChecksum() (string, error) {
+	if c.Checksum != "" {
+		return c.Checksum, nil
+	}
+	if c.ChecksumURL == "" {
+		return "", nil
+	}
+	// imported from bundle, so no network is needed
+	if sum, ok := localChecksum(filepath.Base(c.LocalPath())); ok {
+		return sum, nil
+	}
+	errs := make([]string, 0)
+	for _, src := range mirrorSources(c.ChecksumURL, c.templateValues(), c.mirrors()) {
+		sum, err := fetchChecksum(src.URL, path.Base(c.DownloadURL()))
+		if err == nil {
+			return sum, nil
+		}
+		// served by mirror, but not listed, other mirrors may still have a newer file
+		if _, ok := err.(*ChecksumNotFoundError); !ok {
+			mirrorHealth.Report(src.Mirror, err)
+		}
+		errs = append(errs, err.Error())
+	}
+	return "", errMirrors(errs)
+}
+
+// saveChecksum record checksum from ChecksumURL into SHA256SUMS, so it is not fetched again when offline
+func (c *Component) saveChecksum(checksum string) error {
+	if checksum == "" || c.Checksum != "" {
+		return nil
+	}
+	name := filepath.Base(c.LocalPath())
+	if sum, ok := localChecksum(name); ok && strings.EqualFold(sum, checksum) {
+		return nil
+	}
+	return saveLocalChecksums(map[string]string{name: strings.ToLower(checksum)})
+}
+
+// Fetch download component into resourcesDir, and return the local file to install
+// For tar.gz, the returned file is the one named basename(DevicePath) inside the archive
+// For zip, the returned one is the dir extracted to
+func (c *Component) Fetch() (localPath string, err error) {
+	dstPath := c.LocalPath()
+	// devices may be inited at the same time, other u2init may share resourcesDir
+	unlock, err := lockResource(dstPath)
+	if err != nil {
+		return "", errors.Wrap(err, c.Name)
+	}
+	defer unlock()
+
+	checksum, err := c.ExpectedChecksum()
+	if err != nil {
+		// eg: no network, the file is verified when it was downloaded
+		if !fileExists(dstPath) {
+			return "", errors.Wrap(err, c.Name)
+		}
+		log.Warnf("%s: %v, use cached %s without verify", c.Name, err, filepath.Base(dstPath))
+	}
+	// peers in LAN first
+	sources := append(peerSources(checksum), c.sources()...)
+	cached, err := httpDownload(dstPath, sources, checksum)
+	if err != nil {
+		return "", errors.Wrap(err, c.Name)
+	}
+	if cached {
+		log.Info("Use cached resource", dstPath)
+	}
+	if err = c.saveChecksum(checksum); err != nil {
+		log.Warnf("save checksum of %s: %v", filepath.Base(dstPath), err)
+	}
+	switch c.Install {
+	case INSTALL_TARGZ:
+		dir, err := extractTarGz(dstPath)
+		if err != nil {
+			return "", err
+		}
+		localPath = filepath.Join(dir, path.Base(c.DevicePath))
+		if !fileExists(localPath) {
+			return "", fmt.Errorf("%s: %s not found in %s", c.Name, path.Base(c.DevicePath), filepath.Base(dstPath))
+		}
+		return localPath, nil
+	case INSTALL_ZIP:
+		// github archive has a top level dir named ${NAME}-${VERSION}
+		return extractZip(dstPath)
+	}
+	return dstPath, nil
+}
+
+// Manifest list all components, loaded at startup
+type Manifest struct {
+	mu         sync.RWMutex
+	Components []*Component  `json:"components" yaml:"components"`
+	Policy     *DevicePolicy `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Quirks     []*Quirk      `json:"quirks,omitempty" yaml:"quirks,omitempty"`   // applied after builtin quirks
+	Mirrors    []Mirror      `json:"mirrors,omitempty" yaml:"mirrors,omitempty"` // replace ${MIRROR}, tried in order
+
+	defaults map[string]Component // components before changed by SetVersion, restored by ResetVersion
+}
+
+func defaultManifest() *Manifest {
+	return &Manifest{
+		Components: []*Component{
+			{
+				Name:    "stf-binaries",
+				Version: "0.2",
+				URL:     "${MIRROR}/openatx/stf-binaries/archive/${VERSION}.zip",
+				Install: INSTALL_ZIP,
+			},
+			{
+				Name:        "atx-agent",
+				Version:     "0.5.1",
+				Constraint:  ">= ${VERSION}",
+				URL:         "${MIRROR}/openatx/atx-agent/releases/download/${VERSION}/atx-agent_${VERSION}_linux_${ARCH}.tar.gz",
+				ChecksumURL: "${MIRROR}/openatx/atx-agent/releases/download/${VERSION}/atx-agent_${VERSION}_checksums.txt",
+				DevicePath:  "/data/local/tmp/atx-agent",
+				Install:     INSTALL_TARGZ,
+			},
+			{
+				Name:       "app-uiautomator",
+				Version:    "1.1.7",
+				Constraint: ">= ${VERSION}",
+				URL:        "${MIRROR}/openatx/android-uiautomator-server/releases/download/${VERSION}/app-uiautomator.apk",
+				DevicePath: "/sdcard/tmp/",
+				Install:    INSTALL_APK,
+				Package:    "com.github.uiautomator",
+			},
+			{
+				Name:       "app-uiautomator-test",
+				Version:    "1.1.7",
+				Constraint: ">= ${VERSION}",
+				URL:        "${MIRROR}/openatx/android-uiautomator-server/releases/download/${VERSION}/app-uiautomator-test.apk",
+				DevicePath: "/sdcard/tmp/",
+				Install:    INSTALL_APK,
+				Package:    "com.github.uiautomator.test",
+			},
+			{
+				Name:       "recorder",
+				Version:    "1.3",
+				URL:        "${MIRROR}/openatx/android-uiautomator-server/releases/download/1.1.5/com.easetest.recorder_${VERSION}.apk",
+				DevicePath: "/sdcard/tmp/",
+				Install:    INSTALL_APK,
+				Package:    "com.easetest.recorder",
+			},
+		},
+	}
+}
+
+// builtinComponents are installed by ATXKeeper, others installed by ComponentStep
+var builtinComponents = []string{"stf-binaries", "atx-agent", "app-uiautomator", "app-uiautomator-test", "recorder"}
+
+// loadManifest read json or yaml file, components in file replace the default ones with the same name
+func loadManifest(filename string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, m)
+	default:
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "parse manifest "+filename)
+	}
+	merged := defaultManifest()
+	merged.Policy = m.Policy
+	merged.Quirks = m.Quirks
+	if err := merged.SetMirrors(m.Mirrors); err != nil {
+		return nil, err
+	}
+	for _, c := range m.Components {
+		if err := c.validate(); err != nil {
+			return nil, err
+		}
+		merged.set(c)
+	}
+	return merged, nil
+}
+
+func (c *Component) validate() error {
+	if c.Name == "" {
+		return errors.New("manifest: component name is required")
+	}
+	if c.URL == "" {
+		return fmt.Errorf("manifest: component %s url is required", c.Name)
+	}
+	switch c.Install {
+	case INSTALL_APK, INSTALL_ZIP:
+	case INSTALL_BINARY, INSTALL_TARGZ:
+		if c.DevicePath == "" {
+			return fmt.Errorf("manifest: component %s devicePath is required", c.Name)
+		}
+	default:
+		return fmt.Errorf("manifest: component %s unknown install mode %s", c.Name, strconv.Quote(c.Install))
+	}
+	for i := range c.Mirrors {
+		if err := c.Mirrors[i].validate(); err != nil {
+			return errors.Wrap(err, c.Name)
+		}
+	}
+	if c.Constraint != "" {
+		if ok, reason := c.Accepts(c.Version); !ok {
+			return fmt.Errorf("manifest: component %s %s", c.Name, reason)
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) set(c *Component) {
+	for i, old := range m.Components {
+		if old.Name == c.Name {
+			m.Components[i] = c
+			return
+		}
+	}
+	m.Components = append(m.Components, c)
+}
+
+// SetMirrors replace the global mirrors, used by manifest and command line flags
+func (m *Manifest) SetMirrors(mirrors []Mirror) error {
+	for i := range mirrors {
+		if err := mirrors[i].validate(); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Mirrors = mirrors
+	return nil
+}
+
+// SetVersion change version of a component, used by command line flags and atx-server
+// Pinned checksums are for the old version, so they are cleared and ChecksumURL is used instead
+func (m *Manifest) SetVersion(name, version string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.Components {
+		if c.Name != name || c.Version == version {
+			continue
+		}
+		if _, ok := m.defaults[name]; !ok {
+			if m.defaults == nil {
+				m.defaults = make(map[string]Component)
+			}
+			m.defaults[name] = *c
+		}
+		c.Version = version
+		c.Checksum = ""
+		// copied, since Resources may be reading the old overrides
+		overrides := make([]ComponentOverride, len(c.Overrides))
+		for i, o := range c.Overrides {
+			if o.Version == "" {
+				o.Checksum = ""
+			}
+			overrides[i] = o
+		}
+		c.Overrides = overrides
+	}
+}
+
+// ResetVersion restore version and checksums loaded from manifest, undo SetVersion
+func (m *Manifest) ResetVersion(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.defaults[name]
+	if !ok {
+		return
+	}
+	for _, c := range m.Components {
+		if c.Name == name {
+			c.Version, c.Checksum, c.Overrides = d.Version, d.Checksum, d.Overrides
+		}
+	}
+	delete(m.defaults, name)
+}
+
+// Resolve return a copy of the component, with the matched overrides applied in order
+func (m *Manifest) Resolve(name string, props map[string]string) *Component {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, c := range m.Components {
+		if c.Name != name {
+			continue
+		}
+		rc := *c
+		rc.Overrides = nil
+		for _, o := range c.Overrides {
+			if o.Match.Match(props) {
+				rc.apply(o)
+			}
+		}
+		return &rc
+	}
+	return nil
+}
+
+// Resources return every file needed by manifest, each override and each atx-agent arch is a separate one
+func (m *Manifest) Resources() []*Component {
+	m.mu.RLock()
+	components := make([]Component, 0, len(m.Components))
+	for _, c := range m.Components {
+		components = append(components, *c)
+	}
+	m.mu.RUnlock()
+
+	resources := make([]*Component, 0)
+	seen := make(map[string]bool)
+	for _, c := range components {
+		variants := []Component{c}
+		for _, o := range c.Overrides {
+			v := c
+			v.apply(o)
+			variants = append(variants, v)
+		}
+		for _, v := range variants {
+			v.Overrides = nil
+			archs := []string{""}
+			if strings.Contains(v.URL, "${ARCH}") {
+				archs = allAgentArchs()
+			}
+			for _, arch := range archs {
+				rc := v
+				rc.Arch = arch
+				if seen[rc.LocalPath()] {
+					continue
+				}
+				seen[rc.LocalPath()] = true
+				resources = append(resources, &rc)
+			}
+		}
+	}
+	return resources
+}
+
+// Extra return components not handled by ATXKeeper
+func (m *Manifest) Extra() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := make([]string, 0)
+	for _, c := range m.Components {
+		if !containsString(builtinComponents, c.Name) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+var manifest = defaultManifest()
+var resourceLocks = &KeyedMutex{}
+
+// ComponentStep install component listed in manifest but not known by ATXKeeper
+type ComponentStep struct {
+	Component string
+}
+
+func (s *ComponentStep) Name() string      { return s.Component }
+func (s *ComponentStep) Depends() []string { return nil }
+
+// resolveComponent return component for device with pins applied
+func resolveComponent(d *ProvisionDevice, name string) (c *Component, skip bool) {
+	c = manifest.Resolve(name, d.Props)
+	return c, pins.Apply(d.Serial, c)
+}
+
+func (s *ComponentStep) ShouldRun(d *ProvisionDevice) bool {
+	c, skip := resolveComponent(d, s.Component)
+	if c == nil || skip || c.Install == INSTALL_ZIP {
+		return false
+	}
+	if c.Install != INSTALL_APK || c.Package == "" {
+		return true
+	}
+	info, err := d.Device.StatPackage(c.Package)
+	if err != nil {
+		return true
+	}
+	ok, _ := c.Accepts(info.Version.Name)
+	return !ok
+}
+
+func (s *ComponentStep) Plan(d *ProvisionDevice) []PlanItem {
+	c, skip := resolveComponent(d, s.Component)
+	item := PlanItem{Step: s.Component, Component: s.Component, Action: PLAN_SKIP}
+	switch {
+	case c == nil:
+		item.Reason = "not in manifest"
+	case skip:
+		item.Reason = "pinned, not touched"
+	case c.Install == INSTALL_ZIP:
+		item.Reason = "resource only, not installed"
+	case c.Install == INSTALL_APK && c.Package != "":
+		item = planPackage(d.Device, s.Component, c)
+	case c.Install == INSTALL_APK:
+		item.Desired = c.Version
+		item.Action = PLAN_INSTALL
+		item.Reason = "package name unknown, always installed"
+	default:
+		item.Desired = c.Version
+		item.Action = PLAN_INSTALL
+		item.Reason = "push to " + c.DevicePath
+		if _, err := d.Device.Stat(c.DevicePath); err == nil {
+			item.Action = PLAN_UPGRADE
+			item.Reason = c.DevicePath + " exists, version unknown, always pushed"
+		}
+	}
+	return []PlanItem{item}
+}
+
+func (s *ComponentStep) Run(d *ProvisionDevice) error {
+	c, _ := resolveComponent(d, s.Component)
+	return d.Keeper.installComponent(c)
+}
+
+func (s *ComponentStep) Deprovision(d *ProvisionDevice, r *DeprovisionReport) {
+	c := manifest.Resolve(s.Component, d.Props)
+	switch c.Install {
+	case INSTALL_APK:
+		if c.Package != "" {
+			r.UninstallPackage(d.Device, c.Package)
+		}
+	case INSTALL_BINARY, INSTALL_TARGZ:
+		r.RemoveFile(d.Device, c.DevicePath)
+	}
+}
+
+// useManifest replace the global manifest, and register steps for extra components
+func useManifest(m *Manifest) {
+	manifest = m
+	for _, name := range m.Extra() {
+		RegisterProvisionStep(&ComponentStep{Component: name})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestComponentAccepts(t *testing.T) {
+	tests := []struct {
+		version, constraint, installed string
+		ok                             bool
+	}{
+		{"1.1.7", "", "1.1.7", true},
+		{"1.1.7", "", "1.1.8", false},
+		{"1.1.7", "", "", false},
+		{"1.1.7", ">= ${VERSION}", "1.1.7", true},
+		{"1.1.7", ">= ${VERSION}", "1.1.8", true},
+		{"1.1.7", ">= ${VERSION}", "1.1.5", false},
+		{"1.1.7", ">= ${VERSION}", "dev", false},
+		{"1.1.7", ">= 1.1.5, < 2.0.0", "1.1.5", true},
+		{"1.1.7", ">= 1.1.5, < 2.0.0", "2.0.0", false},
+		{"0.5.1", "~0.5", "0.5.3", true},
+		{"0.5.1", "~0.5", "0.6.0", false},
+		{"1.1.7", "not a range", "1.1.7", false},
+	}
+	for _, tt := range tests {
+		c := &Component{Name: "app-uiautomator", Version: tt.version, Constraint: tt.constraint}
+		ok, reason := c.Accepts(tt.installed)
+		if ok != tt.ok {
+			t.Errorf("version %s constraint %q installed %q expect %v, got %v (%s)",
+				tt.version, tt.constraint, tt.installed, tt.ok, ok, reason)
+		}
+	}
+}
+
+func TestComponentValidateConstraint(t *testing.T) {
+	c := &Component{Name: "app-uiautomator", Version: "1.1.7", URL: "http://example.org/a.apk", Install: INSTALL_APK}
+	c.Constraint = ">= 1.1.5"
+	if err := c.validate(); err != nil {
+		t.Errorf("expect valid, got %v", err)
+	}
+	c.Constraint = "< 1.1.5"
+	if err := c.validate(); err == nil {
+		t.Errorf("preferred version out of constraint should be invalid")
+	}
+}
+
+func TestPinClearConstraint(t *testing.T) {
+	c := manifest.Resolve("atx-agent", nil)
+	if c.Constraint == "" {
+		t.Fatal("atx-agent should have a default constraint")
+	}
+	store := &PinStore{pins: map[string]Pins{"3ffecdf": {"atx-agent": "0.4.9"}}}
+	store.Apply("3ffecdf", c)
+	if ok, _ := c.Accepts("0.5.1"); ok {
+		t.Errorf("pinned component should only accept the pinned version")
+	}
+}
+
+func TestSetVersionClearChecksum(t *testing.T) {
+	m := &Manifest{Components: []*Component{{
+		Name:     "atx-agent",
+		Version:  "0.5.1",
+		Checksum: "e3b0c44298fc1c149afbf4c8996fb924",
+		Overrides: []ComponentOverride{
+			{Checksum: "0123456789abcdef"},
+			{Version: "0.4.9", Checksum: "fedcba9876543210"},
+		},
+	}}}
+	m.SetVersion("atx-agent", "0.5.1")
+	if m.Components[0].Checksum == "" {
+		t.Errorf("checksum should be kept if version not changed")
+	}
+	m.SetVersion("atx-agent", "0.5.2")
+	c := m.Components[0]
+	if c.Version != "0.5.2" || c.Checksum != "" {
+		t.Errorf("expect version 0.5.2 without checksum, got %s %q", c.Version, c.Checksum)
+	}
+	if c.Overrides[0].Checksum != "" {
+		t.Errorf("checksum of override without version should be cleared")
+	}
+	if c.Overrides[1].Checksum == "" {
+		t.Errorf("checksum of override with its own version should be kept")
+	}
+}
+
+func TestApplyVersionsReset(t *testing.T) {
+	defer func(m *Manifest) { manifest = m }(manifest)
+	manifest = defaultManifest()
+	origin := manifest.Resolve("app-uiautomator", nil)
+
+	applyVersions(Versions{}, Versions{ApkVersion: "9.9.9"})
+	if c := manifest.Resolve("app-uiautomator", nil); c.Version != "9.9.9" || c.Checksum != "" {
+		t.Fatalf("expect version 9.9.9 from server, got %s %q", c.Version, c.Checksum)
+	}
+	// server cleared the field, back to version in manifest
+	applyVersions(Versions{ApkVersion: "9.9.9"}, Versions{})
+	for _, name := range []string{"app-uiautomator", "app-uiautomator-test"} {
+		if c := manifest.Resolve(name, nil); c.Version != origin.Version || c.Checksum != origin.Checksum {
+			t.Errorf("expect %s %s %q, got %s %q", name, origin.Version, origin.Checksum, c.Version, c.Checksum)
+		}
+	}
+	// not changed by server, so version set by rollout is kept
+	manifest.SetVersion("atx-agent", "0.6.0")
+	applyVersions(Versions{}, Versions{RecordVersion: "1.0.0"})
+	if c := manifest.Resolve("atx-agent", nil); c.Version != "0.6.0" {
+		t.Errorf("expect atx-agent 0.6.0 kept, got %s", c.Version)
+	}
+}
+
+func TestFetchSaveChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+	resourcesDir = dir
+
+	online := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case !online:
+			http.Error(w, "offline", http.StatusBadGateway)
+		case r.URL.Path == "/checksums.txt":
+			fmt.Fprintln(w, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  app.apk")
+		default:
+			w.Write(nil)
+		}
+	}))
+	defer ts.Close()
+
+	c := &Component{
+		Name:        "app",
+		Version:     "1.0.0",
+		URL:         ts.URL + "/app.apk",
+		ChecksumURL: ts.URL + "/checksums.txt",
+		Install:     INSTALL_APK,
+	}
+	if _, err = c.Fetch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := localChecksum("app-1.0.0.apk"); !ok {
+		t.Errorf("checksum should be saved into %s", localChecksumsFile)
+	}
+
+	// neither checksum nor file can be downloaded, the cached file is used
+	online = false
+	os.Remove(filepath.Join(dir, localChecksumsFile))
+	checksumsCache.Lock()
+	delete(checksumsCache.m, c.ChecksumURL)
+	checksumsCache.Unlock()
+	if _, err = c.Fetch(); err != nil {
+		t.Errorf("cached file should be used when checksum can not be fetched, got %v", err)
+	}
+}
+
+func TestExpectedChecksumNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+	resourcesDir = dir
+
+	listed := "other.apk"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  "+listed)
+	}))
+	defer ts.Close()
+	c := &Component{
+		Name:        "app",
+		Version:     "1.0.0",
+		URL:         "${MIRROR}/app.apk",
+		ChecksumURL: "${MIRROR}/checksums.txt",
+		Mirrors:     []Mirror{{URL: ts.URL}},
+		Install:     INSTALL_APK,
+	}
+	if _, err = c.ExpectedChecksum(); err == nil {
+		t.Fatal("expect checksum not found")
+	}
+	for _, s := range mirrorHealth.Stats(c.Mirrors) {
+		if s.Failures != 0 {
+			t.Errorf("checksum not listed should not be a mirror failure, got %+v", s)
+		}
+	}
+
+	// published again, seen after cache expired
+	listed = "app.apk"
+	checksumsCache.Lock()
+	cached := checksumsCache.m[ts.URL+"/checksums.txt"]
+	cached.fetchedAt = time.Now().Add(-checksumsCacheTTL)
+	checksumsCache.m[ts.URL+"/checksums.txt"] = cached
+	checksumsCache.Unlock()
+	if _, err = c.ExpectedChecksum(); err != nil {
+		t.Errorf("expect checksum fetched again, got %v", err)
+	}
+}
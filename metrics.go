@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics in prometheus text format, see https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type metricSample struct {
+	labelValues []string
+	value       float64
+}
+
+type metricWriter interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metricWriter
+)
+
+func registerMetric(m metricWriter) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range metrics {
+		m.writeTo(w)
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels return {name="value",...}, extra is appended as the last pair
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(values[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[0], extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeSamples(w io.Writer, name string, labels []string, samples []metricSample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") < strings.Join(samples[j].labelValues, "\xff")
+	})
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.labelValues), formatFloat(s.value))
+	}
+}
+
+// Metric is a counter or gauge with labels
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string // counter or gauge
+	Labels []string
+
+	mu      sync.Mutex
+	samples map[string]*metricSample
+}
+
+func newMetric(typ, name, help string, labels ...string) *Metric {
+	m := &Metric{
+		Name:    name,
+		Help:    help,
+		Type:    typ,
+		Labels:  labels,
+		samples: make(map[string]*metricSample),
+	}
+	registerMetric(m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *Metric {
+	return newMetric("counter", name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *Metric {
+	return newMetric("gauge", name, help, labels...)
+}
+
+func (m *Metric) sample(labelValues []string) *metricSample {
+	if len(labelValues) != len(m.Labels) {
+		panic(fmt.Sprintf("metric %s expect %d label values, got %d", m.Name, len(m.Labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &metricSample{labelValues: append([]string{}, labelValues...)}
+		m.samples[key] = s
+	}
+	return s
+}
+
+func (m *Metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(labelValues).value += v
+}
+
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *Metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sample(labelValues).value = v
+}
+
+func (m *Metric) writeTo(w io.Writer) {
+	m.mu.Lock()
+	samples := make([]metricSample, 0, len(m.samples))
+	for _, s := range m.samples {
+		samples = append(samples, *s)
+	}
+	m.mu.Unlock()
+	writeHeader(w, m.Name, m.Help, m.Type)
+	writeSamples(w, m.Name, m.Labels, samples)
+}
+
+// MetricFunc collect samples when scraped
+type MetricFunc struct {
+	Name    string
+	Help    string
+	Type    string
+	Labels  []string
+	Collect func() []metricSample
+}
+
+func newMetricFunc(typ, name, help string, collect func() []metricSample, labels ...string) *MetricFunc {
+	m := &MetricFunc{Name: name, Help: help, Type: typ, Labels: labels, Collect: collect}
+	registerMetric(m)
+	return m
+}
+
+func (m *MetricFunc) writeTo(w io.Writer) {
+	writeHeader(w, m.Name, m.Help, m.Type)
+	writeSamples(w, m.Name, m.Labels, m.Collect())
+}
+
+// Histogram count observations in buckets, buckets are upper bounds
+type Histogram struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // not cumulative
+	sum         float64
+	count       uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registerMetric(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.Buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, upper := range h.Buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeHeader(w, h.Name, h.Help, "histogram")
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.Buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, s.labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.Labels, s.labelValues), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, formatLabels(h.Labels, s.labelValues), s.count)
+	}
+}
+
+// metrics of u2init
+var (
+	metricInitAttempts  = newCounter("u2init_init_attempts_total", "Number of device inits started.")
+	metricInitFailures  = newCounter("u2init_init_failures_total", "Number of device inits failed.")
+	metricStepDuration  = newHistogram("u2init_step_duration_seconds", "Duration of provision steps.", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300}, "step", "status")
+	metricHeartbeats    = newCounter("u2init_heartbeats_total", "Number of heartbeats sent to atx-server.", "result")
+	metricPushes        = newCounter("u2init_push_total", "Number of files pushed to devices.", "result")
+	metricPushBytes     = newCounter("u2init_push_bytes_total", "Bytes pushed to devices.")
+	metricPushSeconds   = newCounter("u2init_push_seconds_total", "Time spent on pushing files to devices.")
+	metricDownloadBytes = newCounter("u2init_resource_download_bytes_total", "Bytes of resources and apks downloaded.")
+	metricInstalls      = newCounter("u2init_package_installs_total", "Outcomes of apk installs through REST API.", "status")
+
+	metricFlashgetCacheHits   = newCounter("u2init_flashget_cache_hits_total", "Apks served from flashget cache without downloading.")
+	metricFlashgetCacheMisses = newCounter("u2init_flashget_cache_misses_total", "Apks not in flashget cache, downloaded from sources.")
+
+	metricMirrorDownloads = newCounter("u2init_mirror_downloads_total", "Downloads of resources and apks by mirror and result.", "mirror", "result")
+	metricPeerDownloads   = newCounter("u2init_peer_downloads_total", "Downloads from peers by result, not cached by peer is not counted.", "peer", "result")
+	metricPeerServed      = newCounter("u2init_peer_served_total", "Cache requests from peers by result.", "result")
+)
+
+func init() {
+	newMetricFunc("gauge", "u2init_devices", "Number of devices by state.", func() []metricSample {
+		counts := make(map[string]int)
+		for _, d := range dm.All() {
+			counts[d.State]++
+		}
+		samples := make([]metricSample, 0, len(counts))
+		for state, n := range counts {
+			samples = append(samples, metricSample{labelValues: []string{state}, value: float64(n)})
+		}
+		return samples
+	}, "state")
+
+	flashgetStat := func(fn func() float64) func() []metricSample {
+		return func() []metricSample {
+			if packageManager == nil {
+				return nil
+			}
+			return []metricSample{{value: fn()}}
+		}
+	}
+	newMetricFunc("gauge", "u2init_flashget_cache_bytes", "Size of files cached by flashget.", flashgetStat(func() float64 {
+		return float64(packageManager.dmer.Stats().CacheSize)
+	}))
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+}
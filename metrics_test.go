@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsText(t *testing.T) {
+	c := &Metric{Name: "test_total", Help: "Test counter.", Type: "counter", Labels: []string{"result"}, samples: make(map[string]*metricSample)}
+	c.Inc("success")
+	c.Add(2, "failure")
+	c.Inc("success")
+
+	h := &Histogram{Name: "test_seconds", Help: "Test histogram.", Labels: []string{"step"}, Buckets: []float64{1, 5}, series: make(map[string]*histogramSeries)}
+	h.Observe(0.5, "atx-agent")
+	h.Observe(3, "atx-agent")
+	h.Observe(10, "atx-agent")
+
+	buf := &bytes.Buffer{}
+	c.writeTo(buf)
+	h.writeTo(buf)
+	expect := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{result="failure"} 2
+test_total{result="success"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{step="atx-agent",le="1"} 1
+test_seconds_bucket{step="atx-agent",le="5"} 2
+test_seconds_bucket{step="atx-agent",le="+Inf"} 3
+test_seconds_sum{step="atx-agent"} 13.5
+test_seconds_count{step="atx-agent"} 3
+`
+	if buf.String() != expect {
+		t.Errorf("expect:\n%s\ngot:\n%s", expect, buf.String())
+	}
+}
+
+func TestFormatLabelsEscape(t *testing.T) {
+	got := formatLabels([]string{"error"}, []string{"say \"hi\"\n"})
+	if !strings.Contains(got, `error="say \"hi\"\n"`) {
+		t.Errorf("label not escaped: %s", got)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// Capabilities is what the device can do after provisioned
+type Capabilities struct {
+	Screenshot  bool `json:"screenshot"`  // minicap works
+	Touch       bool `json:"touch"`       // minitouch works
+	Uiautomator bool `json:"uiautomator"` // uiautomator apks installed
+}
+
+// Full return true if all capabilities are available
+func (c Capabilities) Full() bool {
+	return c.Screenshot && c.Touch && c.Uiautomator
+}
+
+// stfBinariesDir return node_modules of stf-binaries extracted into resourcesDir
+// The dir stf-binaries-${VERSION} unpacked by hand is used if the archive is not downloaded
+func stfBinariesDir() string {
+	c := manifest.Resolve("stf-binaries", nil)
+	if c == nil {
+		return filepath.Join(resourcesDir, "stf-binaries", "node_modules")
+	}
+	dir := resourcesDir
+	if sum, err := cachedFileSHA256(c.LocalPath()); err == nil {
+		dir = extractDir(c.LocalPath(), sum)
+	}
+	return filepath.Join(dir, c.baseName(), "node_modules")
+}
+
+// minicapPrebuilt return minicap and minicap.so path for the first abi which has a prebuilt for sdk
+func minicapPrebuilt(abis []string, sdk string) (bin, so string, err error) {
+	for _, abi := range abis {
+		libDir := filepath.Join(stfBinariesDir(), "minicap-prebuilt/prebuilt", abi, "lib")
+		so = filepath.Join(libDir, "android-"+sdk, "minicap.so")
+		bin = filepath.Join(stfBinariesDir(), "minicap-prebuilt/prebuilt", abi, "bin/minicap")
+		if fileExists(so) && fileExists(bin) {
+			return
+		}
+	}
+	return "", "", fmt.Errorf("no minicap prebuilt for abi %s sdk %s, available: %s",
+		strings.Join(abis, ","), sdk, strings.Join(availableMinicapSdks(abis), ","))
+}
+
+// availableMinicapSdks list the android-* directories of minicap prebuilt
+func availableMinicapSdks(abis []string) []string {
+	sdks := make([]string, 0)
+	for _, abi := range abis {
+		infos, err := ioutil.ReadDir(filepath.Join(stfBinariesDir(), "minicap-prebuilt/prebuilt", abi, "lib"))
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			sdk := strings.TrimPrefix(info.Name(), "android-")
+			if info.IsDir() && !containsString(sdks, sdk) {
+				sdks = append(sdks, sdk)
+			}
+		}
+	}
+	return sdks
+}
+
+func minitouchPrebuilt(abis []string) (bin string, err error) {
+	for _, abi := range abis {
+		bin = filepath.Join(stfBinariesDir(), "minitouch-prebuilt/prebuilt", abi, "bin/minitouch")
+		if fileExists(bin) {
+			return
+		}
+	}
+	return "", fmt.Errorf("no minitouch prebuilt for abi %s", strings.Join(abis, ","))
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// probeMinicap run minicap -i, which print display info in json if minicap works
+func probeMinicap(device *goadb.Device) bool {
+	output, err := runTimeoutCommand(device, 10*time.Second,
+		"LD_LIBRARY_PATH=/data/local/tmp", "/data/local/tmp/minicap", "-i")
+	return err == nil && strings.Contains(output, `"width"`)
+}
+
+// probeMinitouch run minitouch -h, which print usage if minitouch works
+func probeMinitouch(device *goadb.Device) bool {
+	output, err := runTimeoutCommand(device, 10*time.Second, "/data/local/tmp/minitouch", "-h")
+	return err == nil && strings.Contains(output, "Usage")
+}
+
+// miniToolsTarget return abis and sdks used to find prebuilt minicap and minitouch
+func miniToolsTarget(d *ProvisionDevice) (abis []string, sdks []string) {
+	abis = deviceAbis(d.Props)
+	if len(abis) == 0 {
+		abis = []string{d.Abi}
+	}
+	sdks = []string{d.Sdk}
+	if base := d.Props["ro.build.version.sdk"]; base != d.Sdk {
+		sdks = append(sdks, base) // preview sdk not found, try the release one
+	}
+	return
+}
+
+// initSTFMiniTools push minicap and minitouch, and check if they works
+// Missing prebuilts or not working binaries are not errors, the device is marked degraded instead
+func initSTFMiniTools(ctx context.Context, d *ProvisionDevice) error {
+	abis, sdks := miniToolsTarget(d)
+
+	d.Capabilities.Screenshot = false
+	for _, sdk := range sdks {
+		bin, so, err := minicapPrebuilt(abis, sdk)
+		if err != nil {
+			log.Warnf("%s minicap: %v", d.Serial, err)
+			continue
+		}
+		if err := writeFileToDeviceContext(ctx, d.Device, so, "/data/local/tmp/minicap.so", 0644); err != nil {
+			log.Warnf("%s minicap.so: %v", d.Serial, err)
+			break
+		}
+		if err := writeFileToDeviceContext(ctx, d.Device, bin, "/data/local/tmp/minicap", 0755); err != nil {
+			log.Warnf("%s minicap: %v", d.Serial, err)
+			break
+		}
+		d.Capabilities.Screenshot = probeMinicap(d.Device)
+		break
+	}
+
+	d.Capabilities.Touch = false
+	if bin, err := minitouchPrebuilt(abis); err != nil {
+		log.Warnf("%s minitouch: %v", d.Serial, err)
+	} else if err := writeFileToDeviceContext(ctx, d.Device, bin, "/data/local/tmp/minitouch", 0755); err != nil {
+		log.Warnf("%s minitouch: %v", d.Serial, err)
+	} else {
+		d.Capabilities.Touch = probeMinitouch(d.Device)
+	}
+	log.Infof("%s screenshot: %v, touch: %v", d.Serial, d.Capabilities.Screenshot, d.Capabilities.Touch)
+	return ctx.Err()
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openatx/u2init/flashget"
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+)
+
+const (
+	defaultMirrorTimeout = 5 * time.Minute
+	mirrorMaxFailures    = 2               // consecutive failures to mark a mirror unhealthy
+	mirrorCooldown       = 5 * time.Minute // unhealthy mirrors are tried last during cooldown
+)
+
+// Mirror is a site serves the same files as github.com, ${MIRROR} in url is replaced by URL
+type Mirror struct {
+	URL     string `json:"url" yaml:"url"`
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"` // for one file, default 5m
+
+	timeout time.Duration
+}
+
+func (m *Mirror) validate() error {
+	if m.URL == "" {
+		return errors.New("manifest: mirror url is required")
+	}
+	m.URL = strings.TrimSuffix(m.URL, "/")
+	m.timeout = defaultMirrorTimeout
+	if m.Timeout != "" {
+		timeout, err := time.ParseDuration(m.Timeout)
+		if err != nil {
+			return errors.Wrap(err, "manifest: mirror "+m.URL+" timeout")
+		}
+		m.timeout = timeout
+	}
+	return nil
+}
+
+// mirrorSource is a candidate url of a file
+type mirrorSource struct {
+	Mirror  string // empty if url not from a mirror
+	URL     string
+	Timeout time.Duration
+	Peer    bool // Mirror is another u2init
+}
+
+// Results of u2init_mirror_downloads_total, the same for resources and apks downloaded by flashget
+const (
+	DOWNLOAD_HIT     = "hit" // found in local cache, mirror is "cache"
+	DOWNLOAD_SUCCESS = "success"
+	DOWNLOAD_FAILURE = "failure"
+)
+
+// report record result of downloading from source, file not cached by peer is not a failure
+// written is bytes received from source
+func (src mirrorSource) report(written int64, err error) {
+	metricDownloadBytes.Add(float64(written))
+	result := DOWNLOAD_SUCCESS
+	if err != nil {
+		result = DOWNLOAD_FAILURE
+	}
+	if src.Peer {
+		if !isCacheMiss(err) {
+			peerHealth.Report(src.Mirror, err)
+			metricPeerDownloads.Inc(src.Mirror, result)
+		}
+		return
+	}
+	mirrorHealth.Report(src.Mirror, err)
+	mirror := src.Mirror
+	if mirror == "" {
+		mirror = "direct" // url not from a mirror
+	}
+	metricMirrorDownloads.Inc(mirror, result)
+}
+
+// reportCacheHit record a resource in resourcesDir used without downloading
+// Apks cached by flashget are counted by u2init_flashget_cache_hits_total
+func reportCacheHit() {
+	metricMirrorDownloads.Inc("cache", DOWNLOAD_HIT)
+}
+
+// MirrorStat is health of a mirror
+type MirrorStat struct {
+	URL                 string    `json:"url"`
+	Healthy             bool      `json:"healthy"`
+	Successes           int       `json:"successes"`
+	Failures            int       `json:"failures"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty"`
+	LastFailureAt       time.Time `json:"lastFailureAt,omitempty"`
+	LastServedAt        time.Time `json:"lastServedAt,omitempty"`
+}
+
+func (s *MirrorStat) healthy(now time.Time) bool {
+	return s.ConsecutiveFailures < mirrorMaxFailures || now.Sub(s.LastFailureAt) > mirrorCooldown
+}
+
+// MirrorHealth track results of downloads from mirrors
+type MirrorHealth struct {
+	mu    sync.Mutex
+	stats map[string]*MirrorStat
+}
+
+var mirrorHealth = &MirrorHealth{stats: make(map[string]*MirrorStat)}
+
+func (h *MirrorHealth) stat(mirror string) *MirrorStat {
+	s, ok := h.stats[mirror]
+	if !ok {
+		s = &MirrorStat{URL: mirror}
+		h.stats[mirror] = s
+	}
+	return s
+}
+
+// Report record the result of downloading from a mirror
+func (h *MirrorHealth) Report(mirror string, err error) {
+	if mirror == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stat(mirror)
+	if err != nil {
+		s.Failures++
+		s.ConsecutiveFailures++
+		s.LastError = err.Error()
+		s.LastFailureAt = time.Now()
+		return
+	}
+	s.Successes++
+	s.ConsecutiveFailures = 0
+	s.LastServedAt = time.Now()
+}
+
+// Order return mirrors with the healthy ones first, configured order is kept otherwise
+func (h *MirrorHealth) Order(mirrors []Mirror) []Mirror {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	ordered := append([]Mirror{}, mirrors...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return h.stat(ordered[i].URL).healthy(now) && !h.stat(ordered[j].URL).healthy(now)
+	})
+	return ordered
+}
+
+// Stats return health of mirrors
+func (h *MirrorHealth) Stats(mirrors []Mirror) []MirrorStat {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	stats := make([]MirrorStat, 0, len(mirrors))
+	for _, m := range mirrors {
+		s := *h.stat(m.URL)
+		s.Healthy = s.healthy(now)
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// globalMirrors return mirrors in manifest, or github.com if none
+func globalMirrors() []Mirror {
+	manifest.mu.RLock()
+	defer manifest.mu.RUnlock()
+	if len(manifest.Mirrors) > 0 {
+		return manifest.Mirrors
+	}
+	return []Mirror{{URL: GITHUB_MIRROR, timeout: defaultMirrorTimeout}}
+}
+
+// mirrorSources expand ${MIRROR} of template with every mirror, the healthy ones first
+func mirrorSources(template string, values map[string]string, mirrors []Mirror) []mirrorSource {
+	if !strings.Contains(template, "${MIRROR}") {
+		return []mirrorSource{{URL: FormatString(template, values), Timeout: defaultMirrorTimeout}}
+	}
+	sources := make([]mirrorSource, 0, len(mirrors))
+	for _, m := range mirrorHealth.Order(mirrors) {
+		vs := make(map[string]string, len(values))
+		for k, v := range values {
+			vs[k] = v
+		}
+		vs["MIRROR"] = m.URL
+		sources = append(sources, mirrorSource{Mirror: m.URL, URL: FormatString(template, vs), Timeout: m.timeout})
+	}
+	return sources
+}
+
+// flashgetSources let flashget try peers first, then other mirrors for urls of a known mirror
+func flashgetSources(url string, checksum string) []flashget.Source {
+	sources := peerSources(checksum)
+	mirrors := globalMirrors()
+	origin := []mirrorSource{{URL: url}}
+	for _, m := range append([]Mirror{{URL: GITHUB_MIRROR}}, mirrors...) {
+		if strings.HasPrefix(url, m.URL+"/") {
+			origin = mirrorSources("${MIRROR}"+strings.TrimPrefix(url, m.URL), nil, mirrors)
+			break
+		}
+	}
+	result := make([]flashget.Source, 0, len(sources)+len(origin))
+	for _, src := range append(sources, origin...) {
+		tag := src.Mirror
+		if src.Peer {
+			tag = flashgetPeerTag + tag
+		}
+		result = append(result, flashget.Source{URL: src.URL, Timeout: src.Timeout, Tag: tag})
+	}
+	return result
+}
+
+const flashgetPeerTag = "peer:"
+
+func flashgetSourceResult(url string, src flashget.Source, written int64, err error) {
+	ms := mirrorSource{Mirror: strings.TrimPrefix(src.Tag, flashgetPeerTag), URL: src.URL, Peer: strings.HasPrefix(src.Tag, flashgetPeerTag)}
+	ms.report(written, err)
+	if err == nil && ms.Mirror != "" {
+		log.Infof("%s served by %s", url, ms.name())
+	}
+}
+
+// name is used in logs
+func (src mirrorSource) name() string {
+	if src.Peer {
+		return "peer " + src.Mirror
+	}
+	return "mirror " + src.Mirror
+}
+
+// errMirrors join errors of every mirror tried
+func errMirrors(errs []string) error {
+	return fmt.Errorf("all mirrors failed: %s", strings.Join(errs, "; "))
+}
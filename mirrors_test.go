@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openatx/u2init/flashget"
+)
+
+func TestMirrorOrder(t *testing.T) {
+	h := &MirrorHealth{stats: make(map[string]*MirrorStat)}
+	mirrors := []Mirror{{URL: "http://a"}, {URL: "http://b"}, {URL: "http://c"}}
+	for i := 0; i < mirrorMaxFailures; i++ {
+		h.Report("http://a", errors.New("timeout"))
+	}
+	h.Report("http://b", errors.New("timeout"))
+	ordered := h.Order(mirrors)
+	if ordered[0].URL != "http://b" || ordered[1].URL != "http://c" || ordered[2].URL != "http://a" {
+		t.Errorf("unhealthy mirror should be tried last, got %v", ordered)
+	}
+	h.stats["http://a"].LastFailureAt = time.Now().Add(-mirrorCooldown - time.Second)
+	if ordered = h.Order(mirrors); ordered[0].URL != "http://a" {
+		t.Errorf("mirror should be healthy again after cooldown, got %v", ordered)
+	}
+	h.Report("http://a", nil)
+	if s := h.Stats(mirrors)[0]; s.ConsecutiveFailures != 0 || s.Successes != 1 || !s.Healthy {
+		t.Errorf("unexpected stat after success: %+v", s)
+	}
+}
+
+func TestMirrorSources(t *testing.T) {
+	mirrors := []Mirror{{URL: "http://m1"}, {URL: "http://m2"}}
+	sources := mirrorSources("${MIRROR}/atx-agent/${VERSION}.tar.gz", map[string]string{"VERSION": "0.5.1"}, mirrors)
+	if len(sources) != 2 || sources[0].URL != "http://m1/atx-agent/0.5.1.tar.gz" || sources[1].Mirror != "http://m2" {
+		t.Errorf("unexpected sources %+v", sources)
+	}
+	sources = mirrorSources("http://example.org/a.apk", nil, mirrors)
+	if len(sources) != 1 || sources[0].Mirror != "" {
+		t.Errorf("url without ${MIRROR} should have only one source, got %+v", sources)
+	}
+}
+
+func TestHTTPDownloadFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+	resourcesDir = dir
+
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer good.Close()
+
+	sources := mirrorSources("${MIRROR}/a.apk", nil, []Mirror{
+		{URL: bad.URL, timeout: time.Second},
+		{URL: good.URL, timeout: time.Second},
+	})
+	dst := filepath.Join(dir, "a.apk")
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if _, err := httpDownload(dst, sources, sum); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != "hello" {
+		t.Errorf("expect file from the second mirror, got %q", data)
+	}
+	if s := mirrorHealth.Stats([]Mirror{{URL: bad.URL}})[0]; s.Failures != 1 {
+		t.Errorf("failure of mirror should be recorded, got %+v", s)
+	}
+}
+
+func TestReportDownload(t *testing.T) {
+	count := func(mirror, result string) float64 {
+		metricMirrorDownloads.mu.Lock()
+		defer metricMirrorDownloads.mu.Unlock()
+		return metricMirrorDownloads.sample([]string{mirror, result}).value
+	}
+	direct, hits := count("direct", DOWNLOAD_FAILURE), count("cache", DOWNLOAD_HIT)
+	// the same for httpDownload and flashget
+	mirrorSource{URL: "http://example.com/a.apk"}.report(0, errors.New("timeout"))
+	flashgetSourceResult("http://example.com/a.apk", flashget.Source{URL: "http://example.com/a.apk"}, 0, errors.New("timeout"))
+	reportCacheHit()
+	if got := count("direct", DOWNLOAD_FAILURE) - direct; got != 2 {
+		t.Errorf("expect 2 direct failures, got %v", got)
+	}
+	if got := count("cache", DOWNLOAD_HIT) - hits; got != 1 {
+		t.Errorf("expect 1 cache hit, got %v", got)
+	}
+
+	peer := "10.0.0.99:7912"
+	mirrorSource{Mirror: peer, Peer: true}.report(10, nil)
+	metricPeerDownloads.mu.Lock()
+	defer metricPeerDownloads.mu.Unlock()
+	if got := metricPeerDownloads.sample([]string{peer, DOWNLOAD_SUCCESS}).value; got != 1 {
+		t.Errorf("expect 1 peer download, got %v", got)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cavaliercoder/grab"
+	"github.com/franela/goreq"
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+)
+
+const peerTimeout = 2 * time.Minute
+
+// PeerSet is other u2init in LAN, configured or discovered from URL
+type PeerSet struct {
+	URL string // returns addresses of peers, refreshed every minute
+
+	mu         sync.RWMutex
+	static     []string
+	discovered []string
+}
+
+var peers = &PeerSet{}
+
+var peerHealth = &MirrorHealth{stats: make(map[string]*MirrorStat)}
+
+// Set replace the configured peers, address format is host:port
+func (ps *PeerSet) Set(addrs []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.static = addrs
+}
+
+// All return peers as mirrors, the healthy ones first
+func (ps *PeerSet) All() []Mirror {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	mirrors := make([]Mirror, 0, len(ps.static)+len(ps.discovered))
+	for _, addr := range append(append([]string{}, ps.static...), ps.discovered...) {
+		m := Mirror{URL: "http://" + addr, timeout: peerTimeout}
+		if !containsMirror(mirrors, m.URL) {
+			mirrors = append(mirrors, m)
+		}
+	}
+	return peerHealth.Order(mirrors)
+}
+
+func containsMirror(mirrors []Mirror, url string) bool {
+	for _, m := range mirrors {
+		if m.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// peerInfo is an item of the list returned by PeerSet.URL, either "host:port" or an object
+type peerInfo struct {
+	ID   string `json:"id"`
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+func (p *peerInfo) UnmarshalJSON(data []byte) error {
+	var addr string
+	if err := json.Unmarshal(data, &addr); err == nil {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		p.IP = host
+		p.Port, err = strconv.Atoi(port)
+		return err
+	}
+	var v struct {
+		ID   string `json:"id"`
+		IP   string `json:"ip"`
+		Port int    `json:"port"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = peerInfo(v)
+	return nil
+}
+
+// parsePeers parse peer list, the one with selfID or selfPort on this host is excluded
+func parsePeers(data []byte, selfID string, selfPort int, localIPs []string) ([]string, error) {
+	var infos []peerInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, errors.Wrap(err, "parse peers")
+	}
+	addrs := make([]string, 0, len(infos))
+	for _, p := range infos {
+		if p.IP == "" || p.Port == 0 || (selfID != "" && p.ID == selfID) {
+			continue
+		}
+		if p.Port == selfPort && containsString(localIPs, p.IP) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(p.IP, strconv.Itoa(p.Port)))
+	}
+	return addrs, nil
+}
+
+func localIPs() []string {
+	ips := []string{"127.0.0.1", "localhost"}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	return ips
+}
+
+func (ps *PeerSet) discover(selfID string, selfPort int) error {
+	res, err := goreq.Request{
+		Method:  "GET",
+		Uri:     ps.URL,
+		Timeout: 10 * time.Second,
+	}.Do()
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("get peers %s: status %d", ps.URL, res.StatusCode)
+	}
+	data, err := res.Body.ToString()
+	if err != nil {
+		return err
+	}
+	addrs, err := parsePeers([]byte(data), selfID, selfPort, localIPs())
+	if err != nil {
+		return err
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.discovered = addrs
+	return nil
+}
+
+// Watch refresh peers from URL every minute
+func (ps *PeerSet) Watch(selfID string, selfPort int) {
+	if ps.URL == "" {
+		return
+	}
+	for {
+		if err := ps.discover(selfID, selfPort); err != nil {
+			log.Warnf("discover peers: %v", err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// peerSources return urls of file in peers, files are served by u2init at
+//
+//	GET /cache/sha256/${SHA256}
+//
+// none if checksum is unknown, so that files from peers are always verified
+func peerSources(checksum string) []mirrorSource {
+	sources := make([]mirrorSource, 0)
+	if checksum == "" {
+		return sources
+	}
+	path := "/cache/sha256/" + strings.ToLower(checksum)
+	for _, p := range peers.All() {
+		sources = append(sources, mirrorSource{Mirror: p.URL, URL: p.URL + path, Timeout: p.timeout, Peer: true})
+	}
+	return sources
+}
+
+// isCacheMiss return true if peer does not have the file, which is not a failure of peer
+func isCacheMiss(err error) bool {
+	code, ok := errors.Cause(err).(grab.StatusCodeError)
+	return ok && int(code) == http.StatusNotFound
+}
+
+// fileSums cache sha256 of files served to peers
+var fileSums = struct {
+	sync.Mutex
+	m map[string]fileSum
+}{m: make(map[string]fileSum)}
+
+type fileSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+func cachedFileSHA256(filename string) (string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	fileSums.Lock()
+	fs, ok := fileSums.m[filename]
+	fileSums.Unlock()
+	if ok && fs.size == info.Size() && fs.modTime.Equal(info.ModTime()) {
+		return fs.sum, nil
+	}
+	sum, err := fileSHA256(filename)
+	if err != nil {
+		return "", err
+	}
+	fileSums.Lock()
+	fileSums.m[filename] = fileSum{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	fileSums.Unlock()
+	return sum, nil
+}
+
+// lookupCache find file with sha256 in resourcesDir and flashget cache
+func lookupCache(checksum string) (filename string, ok bool) {
+	checksum = strings.ToLower(checksum)
+	for _, c := range manifest.Resources() {
+		localPath := c.LocalPath()
+		if !fileExists(localPath) {
+			continue
+		}
+		if sum, err := cachedFileSHA256(localPath); err == nil && sum == checksum {
+			return localPath, true
+		}
+	}
+	if packageManager != nil {
+		for _, dl := range packageManager.dmer.FinishedDownloads() {
+			sum := strings.ToLower(dl.SHA256)
+			if sum == "" {
+				var err error
+				if sum, err = cachedFileSHA256(dl.Filename); err != nil {
+					continue
+				}
+			}
+			if sum == checksum {
+				return dl.Filename, true
+			}
+		}
+	}
+	return "", false
+}
+
+func init() {
+	http.HandleFunc("/cache/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cache/"), "/")
+		if len(parts) != 2 || parts[0] != "sha256" {
+			http.Error(w, "use /cache/sha256/${SHA256}", http.StatusBadRequest)
+			return
+		}
+		filename, ok := lookupCache(parts[1])
+		if !ok {
+			metricPeerServed.Inc("miss")
+			http.NotFound(w, r)
+			return
+		}
+		metricPeerServed.Inc("hit")
+		log.Infof("serve %s to peer %s", filename, r.RemoteAddr)
+		http.ServeFile(w, r, filename)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cavaliercoder/grab"
+)
+
+func TestParsePeers(t *testing.T) {
+	data := []byte(`["10.0.0.2:8000", {"id": "self", "ip": "10.0.0.3", "port": 8000}, {"ip": "10.0.0.4", "port": 8001}, {"ip": "10.0.0.1", "port": 7000}]`)
+	addrs, err := parsePeers(data, "self", 7000, []string{"127.0.0.1", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"10.0.0.2:8000", "10.0.0.4:8001"}
+	if !reflect.DeepEqual(addrs, expect) {
+		t.Errorf("expect %v, got %v", expect, addrs)
+	}
+}
+
+func TestServeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+	resourcesDir = dir
+
+	c := manifest.Resolve("app-uiautomator", nil)
+	if err := ioutil.WriteFile(c.LocalPath(), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	tests := map[string]int{
+		"/cache/sha256/" + sum:                   200,
+		"/cache/sha256/0000":                     404,
+		"/cache/url/0000":                        400,
+		"/cache/" + filepath.Base(c.LocalPath()): 400,
+	}
+	for path, code := range tests {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("GET %s expect %d, got %d", path, code, w.Code)
+		}
+		if code == 200 && w.Body.String() != "hello" {
+			t.Errorf("GET %s expect hello, got %q", path, w.Body.String())
+		}
+	}
+}
+
+func TestPeerSources(t *testing.T) {
+	peers.Set([]string{"10.0.0.2:8000"})
+	defer peers.Set(nil)
+	if sources := peerSources(""); len(sources) != 0 {
+		t.Errorf("peers should not be used without checksum, got %v", sources)
+	}
+	if sources := peerSources("ABCD"); len(sources) != 1 || !strings.HasSuffix(sources[0].URL, "/cache/sha256/abcd") {
+		t.Errorf("expect peer source by sha256, got %v", sources)
+	}
+}
+
+func TestIsCacheMiss(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "u2init-peers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, err = grab.Get(filepath.Join(dir, "a.apk"), ts.URL+"/cache/sha256/0000")
+	if !isCacheMiss(err) {
+		t.Errorf("404 from peer should be a cache miss, got %v", err)
+	}
+}
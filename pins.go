@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// PIN_SKIP means the component in device is never touched
+const PIN_SKIP = "skip"
+
+// Pins is component name to version or PIN_SKIP
+// app-uiautomator-test always follows app-uiautomator
+type Pins map[string]string
+
+// PinStore keeps pins of each device, saved in $stateDir/pins.json
+type PinStore struct {
+	mu       sync.RWMutex
+	filename string
+	pins     map[string]Pins
+}
+
+var pins = &PinStore{pins: make(map[string]Pins)}
+
+// Load read pins from file, not exists file is ok
+func (s *PinStore) Load(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filename = filename
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.pins); err != nil {
+		return errors.Wrap(err, "parse "+filename)
+	}
+	if s.pins == nil {
+		s.pins = make(map[string]Pins)
+	}
+	return nil
+}
+
+func (s *PinStore) save() error {
+	if s.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filename), 0755); err != nil {
+		return err
+	}
+	tmpfile := s.filename + ".tmp"
+	if err := ioutil.WriteFile(tmpfile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, s.filename)
+}
+
+func (s *PinStore) Get(serial string) Pins {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p := make(Pins)
+	for name, version := range s.pins[serial] {
+		p[name] = version
+	}
+	return p
+}
+
+// Set replace all pins of device, empty pins removes them
+func (s *PinStore) Set(serial string, p Pins) error {
+	for name, version := range p {
+		if name == "app-uiautomator-test" {
+			return errors.New("pin app-uiautomator instead, app-uiautomator-test follows it")
+		}
+		if manifest.Resolve(name, nil) == nil {
+			return fmt.Errorf("unknown component: %s", name)
+		}
+		if version == "" {
+			return fmt.Errorf("version of %s is empty", name)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(p) == 0 {
+		delete(s.pins, serial)
+	} else {
+		s.pins[serial] = p
+	}
+	return s.save()
+}
+
+// Apply change component version to the pinned one, return true if component should not be touched
+func (s *PinStore) Apply(serial string, c *Component) (skip bool) {
+	if c == nil {
+		return false
+	}
+	name := c.Name
+	if name == "app-uiautomator-test" {
+		name = "app-uiautomator"
+	}
+	s.mu.RLock()
+	version, ok := s.pins[serial][name]
+	s.mu.RUnlock()
+	switch {
+	case !ok:
+		return false
+	case version == PIN_SKIP:
+		return true
+	case version != c.Version:
+		c.Version = version
+		c.Checksum = "" // checksum in manifest is for the other version, ChecksumURL is used instead
+	}
+	c.Constraint = "" // pinned version only
+	return false
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPinStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "pins.json")
+
+	s := &PinStore{pins: make(map[string]Pins)}
+	if err := s.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("abc", Pins{"atx-agent": "0.4.9", "app-uiautomator": PIN_SKIP}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("abc", Pins{"no-such-component": "1.0"}); err == nil {
+		t.Error("expect error for unknown component")
+	}
+
+	// reload from file
+	s = &PinStore{pins: make(map[string]Pins)}
+	if err := s.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	agent := manifest.Resolve("atx-agent", nil)
+	agent.Checksum = "0000"
+	if s.Apply("abc", agent) || agent.Version != "0.4.9" || agent.Checksum != "" {
+		t.Errorf("atx-agent not pinned: %+v", agent)
+	}
+	if !s.Apply("abc", manifest.Resolve("app-uiautomator-test", nil)) {
+		t.Error("expect app-uiautomator-test follows app-uiautomator")
+	}
+	other := manifest.Resolve("atx-agent", nil)
+	if s.Apply("other", other) || other.Version == "0.4.9" {
+		t.Error("pins of other device should not be applied")
+	}
+
+	if err := s.Set("abc", Pins{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Get("abc")) != 0 {
+		t.Error("expect pins removed")
+	}
+}
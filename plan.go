@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// Plan actions
+const (
+	PLAN_INSTALL = "install"
+	PLAN_UPGRADE = "upgrade"
+	PLAN_RUN     = "run" // step can not tell, it will run anyway
+	PLAN_SKIP    = "skip"
+)
+
+// PlanItem is what a provision step would do to a component
+type PlanItem struct {
+	Step      string `json:"step"`
+	Component string `json:"component"`
+	Action    string `json:"action"`
+	Current   string `json:"current,omitempty"`
+	Desired   string `json:"desired,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// Planner is implemented by steps which can tell what they would do without changing the device
+type Planner interface {
+	Plan(d *ProvisionDevice) []PlanItem
+}
+
+// ProvisionPlan is what will happen when the device is provisioned
+type ProvisionPlan struct {
+	Serial string     `json:"serial"`
+	Items  []PlanItem `json:"items"`
+}
+
+// defaultPlan is used for steps not implement Planner
+func defaultPlan(step ProvisionStep, d *ProvisionDevice) []PlanItem {
+	item := PlanItem{Step: step.Name(), Component: step.Name(), Action: PLAN_RUN, Reason: "always run"}
+	if !step.ShouldRun(d) {
+		item.Action = PLAN_SKIP
+		item.Reason = "not needed"
+	}
+	return []PlanItem{item}
+}
+
+// planDevice run checks of all steps, disabled steps are listed at last
+func planDevice(d *ProvisionDevice) (*ProvisionPlan, error) {
+	steps, err := provisionSteps.Steps()
+	if err != nil {
+		return nil, err
+	}
+	plan := &ProvisionPlan{Serial: d.Serial, Items: make([]PlanItem, 0)}
+	for _, step := range steps {
+		if planner, ok := step.(Planner); ok {
+			plan.Items = append(plan.Items, planner.Plan(d)...)
+		} else {
+			plan.Items = append(plan.Items, defaultPlan(step, d)...)
+		}
+	}
+	for _, name := range provisionSteps.Names() {
+		if !provisionSteps.Enabled(name) {
+			plan.Items = append(plan.Items, PlanItem{Step: name, Component: name, Action: PLAN_SKIP, Reason: "step disabled"})
+		}
+	}
+	return plan, nil
+}
+
+// planPackage compare version of installed package with component
+func planPackage(device *goadb.Device, step string, c *Component) PlanItem {
+	item := PlanItem{Step: step, Component: c.Name, Desired: c.Version}
+	info, err := device.StatPackage(c.Package)
+	if err != nil {
+		item.Action = PLAN_INSTALL
+		item.Reason = fmt.Sprintf("package %s not installed", c.Package)
+		return item
+	}
+	item.Current = info.Version.Name
+	if ok, reason := c.Accepts(item.Current); !ok {
+		item.Action = PLAN_UPGRADE
+		item.Reason = reason
+		return item
+	}
+	item.Action = PLAN_SKIP
+	item.Reason = "up to date"
+	if item.Current != c.Version {
+		item.Reason = fmt.Sprintf("version %s in range %s", item.Current, c.VersionRange())
+	}
+	return item
+}
+
+// planMiniTools resolve prebuilt minicap and minitouch, which are always pushed
+func planMiniTools(d *ProvisionDevice) []PlanItem {
+	abis, sdks := miniToolsTarget(d)
+	minicap := PlanItem{Step: "minitools", Component: "minicap", Desired: "sdk " + d.Sdk}
+	var errs []string
+	for _, sdk := range sdks {
+		bin, so, err := minicapPrebuilt(abis, sdk)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		minicap.Action = PLAN_INSTALL
+		minicap.Reason = "push " + relResource(bin) + ", " + relResource(so)
+		break
+	}
+	if minicap.Action == "" {
+		minicap.Action = PLAN_SKIP
+		minicap.Reason = strings.Join(errs, "; ") + ", device will be degraded"
+	}
+
+	minitouch := PlanItem{Step: "minitools", Component: "minitouch", Action: PLAN_INSTALL}
+	if bin, err := minitouchPrebuilt(abis); err != nil {
+		minitouch.Action = PLAN_SKIP
+		minitouch.Reason = err.Error() + ", device will be degraded"
+	} else {
+		minitouch.Reason = "push " + relResource(bin)
+	}
+	return []PlanItem{minicap, minitouch}
+}
+
+func relResource(path string) string {
+	if rel, err := filepath.Rel(resourcesDir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// planPolicy list settings differ from policy
+func planPolicy(d *ProvisionDevice) []PlanItem {
+	item := PlanItem{Step: "device-policy", Component: "device-policy", Action: PLAN_SKIP, Reason: "policy applied"}
+	if len(manifest.Policy.Settings()) == 0 {
+		item.Reason = "no policy"
+	} else if drifts := checkPolicy(d.Device, manifest.Policy); len(drifts) > 0 {
+		item.Action = PLAN_RUN
+		item.Reason = strings.Join(drifts, "; ")
+	}
+	return []PlanItem{item}
+}
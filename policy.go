@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// DevicePolicy is settings applied to every device after provisioned, nil field means not managed
+type DevicePolicy struct {
+	DisableAnimations *bool    `json:"disableAnimations,omitempty" yaml:"disableAnimations,omitempty"`
+	StayAwake         *bool    `json:"stayAwake,omitempty" yaml:"stayAwake,omitempty"`         // stay awake while charging by USB
+	ScreenTimeout     *int     `json:"screenTimeout,omitempty" yaml:"screenTimeout,omitempty"` // milliseconds
+	DisableVerifier   *bool    `json:"disableVerifier,omitempty" yaml:"disableVerifier,omitempty"`
+	Brightness        *int     `json:"brightness,omitempty" yaml:"brightness,omitempty"` // 0-255, auto brightness is turned off
+	FontScale         *float64 `json:"fontScale,omitempty" yaml:"fontScale,omitempty"`
+	Density           *int     `json:"density,omitempty" yaml:"density,omitempty"` // wm density
+}
+
+// PolicySetting is how to apply and verify one value
+type PolicySetting struct {
+	Name   string
+	Apply  []string
+	Read   []string
+	Expect string
+	Match  func(output, expect string) bool // nil means output equals expect
+}
+
+func (s PolicySetting) matched(output string) bool {
+	output = strings.TrimSpace(output)
+	if s.Match != nil {
+		return s.Match(output, s.Expect)
+	}
+	return output == s.Expect
+}
+
+func settingPut(namespace, key, value string) PolicySetting {
+	return PolicySetting{
+		Name:   namespace + "/" + key,
+		Apply:  []string{"settings", "put", namespace, key, value},
+		Read:   []string{"settings", "get", namespace, key},
+		Expect: value,
+	}
+}
+
+func boolValue(b bool, yes, no string) string {
+	if b {
+		return yes
+	}
+	return no
+}
+
+// Settings expand policy into the commands to run
+func (p *DevicePolicy) Settings() []PolicySetting {
+	settings := make([]PolicySetting, 0)
+	if p == nil {
+		return settings
+	}
+	if p.DisableAnimations != nil {
+		scale := boolValue(*p.DisableAnimations, "0", "1")
+		for _, key := range []string{"window_animation_scale", "transition_animation_scale", "animator_duration_scale"} {
+			settings = append(settings, settingPut("global", key, scale))
+		}
+	}
+	if p.StayAwake != nil {
+		// svc power stayon usb set stay_on_while_plugged_in to 2 (BatteryManager.BATTERY_PLUGGED_USB)
+		settings = append(settings, PolicySetting{
+			Name:   "stay awake",
+			Apply:  []string{"svc", "power", "stayon", boolValue(*p.StayAwake, "usb", "false")},
+			Read:   []string{"settings", "get", "global", "stay_on_while_plugged_in"},
+			Expect: boolValue(*p.StayAwake, "2", "0"),
+		})
+	}
+	if p.ScreenTimeout != nil {
+		settings = append(settings, settingPut("system", "screen_off_timeout", strconv.Itoa(*p.ScreenTimeout)))
+	}
+	if p.DisableVerifier != nil {
+		value := boolValue(*p.DisableVerifier, "0", "1")
+		settings = append(settings,
+			settingPut("global", "package_verifier_enable", value),
+			settingPut("global", "verifier_verify_adb_installs", value))
+	}
+	if p.Brightness != nil {
+		settings = append(settings,
+			settingPut("system", "screen_brightness_mode", "0"),
+			settingPut("system", "screen_brightness", strconv.Itoa(*p.Brightness)))
+	}
+	if p.FontScale != nil {
+		settings = append(settings, settingPut("system", "font_scale", strconv.FormatFloat(*p.FontScale, 'f', -1, 64)))
+	}
+	if p.Density != nil {
+		density := strconv.Itoa(*p.Density)
+		settings = append(settings, PolicySetting{
+			Name:   "density",
+			Apply:  []string{"wm", "density", density},
+			Read:   []string{"wm", "density"},
+			Expect: density,
+			Match: func(output, expect string) bool {
+				// Physical density: 480
+				// Override density: 420
+				if strings.Contains(output, "Override density:") {
+					return strings.Contains(output, "Override density: "+expect)
+				}
+				return strings.Contains(output, "Physical density: "+expect)
+			},
+		})
+	}
+	return settings
+}
+
+func runArgs(device *goadb.Device, args []string) (string, error) {
+	return runCommand(device, args[0], args[1:]...)
+}
+
+// checkPolicy return settings which are not the expected value
+func checkPolicy(device *goadb.Device, p *DevicePolicy) (drifts []string) {
+	for _, s := range p.Settings() {
+		output, err := runArgs(device, s.Read)
+		if err != nil {
+			drifts = append(drifts, fmt.Sprintf("%s: %v", s.Name, err))
+			continue
+		}
+		if !s.matched(output) {
+			drifts = append(drifts, fmt.Sprintf("%s: expect %s, got %s", s.Name, s.Expect, strings.TrimSpace(output)))
+		}
+	}
+	return
+}
+
+// applyPolicy apply all settings, and return the ones not applied
+func applyPolicy(device *goadb.Device, p *DevicePolicy) (drifts []string) {
+	for _, s := range p.Settings() {
+		if output, err := runArgs(device, s.Apply); err != nil {
+			log.Warnf("apply %s: %v %s", s.Name, err, output)
+		}
+	}
+	return checkPolicy(device, p)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+const MB = 1024 * 1024
+
+// Minimum requirements checked before provisioning
+var (
+	PreflightMinDataFree int64 = 40 * MB // atx-agent, minicap and minitouch
+	PreflightMinTmpFree  int64 = 20 * MB // apks
+	PreflightMinBattery        = 5       // percent
+)
+
+// PreflightResult is the device condition gathered before provisioning
+type PreflightResult struct {
+	DataFree    int64    `json:"dataFree"` // bytes, -1 means unknown
+	TmpDir      string   `json:"tmpDir"`
+	TmpFree     int64    `json:"tmpFree"`
+	TmpWritable bool     `json:"tmpWritable"`
+	Battery     int      `json:"battery"` // percent, -1 means unknown
+	SELinux     string   `json:"selinux"` // Enforcing, Permissive or Disabled
+	Problems    []string `json:"problems,omitempty"`
+}
+
+func (r *PreflightResult) Error() error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(r.Problems, "; "))
+}
+
+func humanMB(size int64) string {
+	return fmt.Sprintf("%dMB", size/MB)
+}
+
+// parseSize parse size in df output, 12.5G, 512K or 1K-blocks without unit
+func parseSize(s string, unit int64) (int64, error) {
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		unit, s = 1024, s[:len(s)-1]
+	case 'M':
+		unit, s = MB, s[:len(s)-1]
+	case 'G':
+		unit, s = 1024*MB, s[:len(s)-1]
+	case 'T':
+		unit, s = 1024*1024*MB, s[:len(s)-1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f * float64(unit)), nil
+}
+
+// parseDfFree return free bytes of the first filesystem in df output
+// toybox:  Filesystem 1K-blocks Used Available Use% Mounted on
+// toolbox: Filesystem Size Used Free Blksize
+func parseDfFree(output string) (int64, error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("unexpected df output: %s", strings.TrimSpace(output))
+	}
+	header := strings.Fields(lines[0])
+	column := -1
+	for i, name := range header {
+		if name == "Available" || name == "Avail" || name == "Free" {
+			column = i
+			break
+		}
+	}
+	if column == -1 {
+		return 0, fmt.Errorf("unexpected df header: %s", lines[0])
+	}
+	// long filesystem name may take a line itself
+	fields := strings.Fields(strings.Join(lines[1:], " "))
+	if column >= len(fields) {
+		return 0, fmt.Errorf("unexpected df output: %s", strings.TrimSpace(output))
+	}
+	return parseSize(fields[column], 1024)
+}
+
+func diskFree(device *goadb.Device, dir string) (int64, error) {
+	output, err := runCommand(device, "df", dir)
+	if err != nil {
+		return -1, err
+	}
+	return parseDfFree(output)
+}
+
+var batteryRe = regexp.MustCompile(`(?m)^\s*(level|scale):\s*(\d+)`)
+
+// parseBatteryLevel parse output of dumpsys battery, return percent
+func parseBatteryLevel(output string) (int, error) {
+	level, scale := -1, 100
+	for _, m := range batteryRe.FindAllStringSubmatch(output, -1) {
+		v, _ := strconv.Atoi(m[2])
+		if m[1] == "level" {
+			level = v
+		} else if v > 0 {
+			scale = v
+		}
+	}
+	if level == -1 {
+		return -1, errors.New("battery level not found")
+	}
+	return level * 100 / scale, nil
+}
+
+func tmpWritable(device *goadb.Device, dir string) bool {
+	testFile := dir + "/.u2init-preflight"
+	output, _ := runCommand(device, "sh", "-c",
+		fmt.Sprintf("mkdir -p %s && touch %s && rm %s && echo ok", dir, testFile, testFile))
+	return strings.TrimSpace(output) == "ok"
+}
+
+// preflight gather device condition, problems found are recorded in result
+func preflight(d *ProvisionDevice) *PreflightResult {
+	device := d.Device
+	r := &PreflightResult{
+		DataFree: -1,
+		TmpDir:   d.Keeper.quirk.TmpDir,
+		TmpFree:  -1,
+		Battery:  -1,
+	}
+	var err error
+	if r.DataFree, err = diskFree(device, "/data"); err != nil {
+		r.DataFree = -1
+		r.Problems = append(r.Problems, "df /data: "+err.Error())
+	} else if r.DataFree < PreflightMinDataFree {
+		r.Problems = append(r.Problems, fmt.Sprintf("/data has %s free, need %s",
+			humanMB(r.DataFree), humanMB(PreflightMinDataFree)))
+	}
+
+	r.TmpWritable = tmpWritable(device, r.TmpDir)
+	if !r.TmpWritable {
+		r.Problems = append(r.Problems, r.TmpDir+" is not writable")
+	} else if r.TmpFree, err = diskFree(device, r.TmpDir); err != nil {
+		r.TmpFree = -1
+		r.Problems = append(r.Problems, "df "+r.TmpDir+": "+err.Error())
+	} else if r.TmpFree < PreflightMinTmpFree {
+		r.Problems = append(r.Problems, fmt.Sprintf("%s has %s free, need %s",
+			r.TmpDir, humanMB(r.TmpFree), humanMB(PreflightMinTmpFree)))
+	}
+
+	// battery level is not reported by some emulators, not a problem
+	if output, err := runCommand(device, "dumpsys", "battery"); err == nil {
+		if level, err := parseBatteryLevel(output); err == nil {
+			r.Battery = level
+			if level < PreflightMinBattery {
+				r.Problems = append(r.Problems, fmt.Sprintf("battery %d%%, need %d%%", level, PreflightMinBattery))
+			}
+		}
+	}
+
+	if output, err := runCommand(device, "getenforce"); err == nil {
+		r.SELinux = strings.TrimSpace(output)
+	}
+	return r
+}
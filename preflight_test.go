@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestParseDfFree(t *testing.T) {
+	tests := []struct {
+		output string
+		expect int64
+	}{
+		// toybox
+		{"Filesystem 1K-blocks Used Available Use% Mounted on\n/dev/block/dm-0 52710004 40006084 12572848 77% /data\n", 12572848 * 1024},
+		// toybox, long filesystem name
+		{"Filesystem 1K-blocks Used Available Use% Mounted on\n/dev/block/platform/msm_sdcc.1/by-name/userdata\n 12G 10G 12288 99% /data\n", 12288 * 1024},
+		// toolbox
+		{"Filesystem               Size     Used     Free   Blksize\n/data                   12.0G     3.2G     8.5G   4096\n", int64(8.5 * 1024 * MB)},
+		{"Filesystem               Size     Used     Free   Blksize\n/data                  800.0M   788.0M    12.0M   4096\n", 12 * MB},
+	}
+	for _, tt := range tests {
+		got, err := parseDfFree(tt.output)
+		if err != nil {
+			t.Errorf("parseDfFree(%q) error: %v", tt.output, err)
+			continue
+		}
+		if got != tt.expect {
+			t.Errorf("parseDfFree(%q) expect %d, got %d", tt.output, tt.expect, got)
+		}
+	}
+	if _, err := parseDfFree("df: /data: Permission denied"); err == nil {
+		t.Error("expect error for unexpected output")
+	}
+}
+
+func TestParseBatteryLevel(t *testing.T) {
+	output := "Current Battery Service state:\n  AC powered: false\n  USB powered: true\n  status: 2\n  level: 42\n  scale: 100\n"
+	if level, err := parseBatteryLevel(output); err != nil || level != 42 {
+		t.Errorf("expect battery 42, got %d %v", level, err)
+	}
+	if _, err := parseBatteryLevel("Can't find service: battery"); err == nil {
+		t.Error("expect error when level not found")
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+const (
+	STEP_SUCCESS = "success"
+	STEP_SKIPPED = "skipped"
+	STEP_FAILURE = "failure"
+)
+
+// ProvisionDevice contains everything a step need to know about the device being provisioned
+type ProvisionDevice struct {
+	Ctx        context.Context // canceled when device went offline
+	Serial     string
+	Device     *goadb.Device
+	Props      map[string]string
+	Abi        string
+	Sdk        string
+	ServerAddr string
+	Keeper     *ATXKeeper
+
+	Capabilities Capabilities
+	PolicyDrift  []string
+	Preflight    *PreflightResult
+}
+
+func newProvisionDevice(ctx context.Context, device *goadb.Device, serverAddr string) (*ProvisionDevice, error) {
+	serial, err := device.Serial()
+	if err != nil {
+		return nil, err
+	}
+	props, err := device.Properties()
+	if err != nil {
+		return nil, err
+	}
+	sdk := props["ro.build.version.sdk"]
+	pre := props["ro.build.version.preview_sdk"]
+	if pre != "" && pre != "0" {
+		sdk += pre
+	}
+	return &ProvisionDevice{
+		Ctx:        ctx,
+		Serial:     serial,
+		Device:     device,
+		Props:      props,
+		Abi:        props["ro.product.cpu.abi"],
+		Sdk:        sdk,
+		ServerAddr: serverAddr,
+		Keeper:     newATXKeeper(ctx, device, serial, props, serverAddr),
+	}, nil
+}
+
+// ProvisionStep is one unit of work done when a device came online
+// Steps are registered into StepRegistry, and run in dependency order
+type ProvisionStep interface {
+	Name() string
+	Depends() []string
+	ShouldRun(d *ProvisionDevice) bool
+	Run(d *ProvisionDevice) error
+}
+
+// StepResult record outcome of a single step
+type StepResult struct {
+	Name      string        `json:"name"`
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+
+	err error // returned by Run, kept so callers can check its type
+}
+
+// ProvisionReport record outcome of all steps of a device
+type ProvisionReport struct {
+	Serial    string        `json:"serial"`
+	Steps     []StepResult  `json:"steps"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+
+	Preflight *PreflightResult `json:"preflight,omitempty"`
+}
+
+// StepRegistry keeps all known steps, and which of them are enabled
+type StepRegistry struct {
+	mu       sync.RWMutex
+	steps    map[string]ProvisionStep
+	disabled map[string]bool
+	order    []string // registration order, or specified by SetOrder
+}
+
+func NewStepRegistry() *StepRegistry {
+	return &StepRegistry{
+		steps:    make(map[string]ProvisionStep),
+		disabled: make(map[string]bool),
+	}
+}
+
+// Register add a step, step with the same name will be replaced
+func (r *StepRegistry) Register(step ProvisionStep) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.steps[step.Name()]; !exists {
+		r.order = append(r.order, step.Name())
+	}
+	r.steps[step.Name()] = step
+}
+
+func (r *StepRegistry) Enable(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.steps[name]; !ok {
+		return fmt.Errorf("unknown provision step: %s", name)
+	}
+	delete(r.disabled, name)
+	return nil
+}
+
+func (r *StepRegistry) Disable(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.steps[name]; !ok {
+		return fmt.Errorf("unknown provision step: %s", name)
+	}
+	r.disabled[name] = true
+	return nil
+}
+
+// SetOrder enable only the given steps, and run them in this order
+// Dependencies still run before the steps depend on them
+func (r *StepRegistry) SetOrder(names []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range names {
+		if _, ok := r.steps[name]; !ok {
+			return fmt.Errorf("unknown provision step: %s", name)
+		}
+	}
+	order := append([]string{}, names...)
+	disabled := make(map[string]bool)
+	for name := range r.steps {
+		if !containsString(names, name) {
+			order = append(order, name)
+			disabled[name] = true
+		}
+	}
+	r.order = order
+	r.disabled = disabled
+	return nil
+}
+
+// Names return all registered step names in order
+func (r *StepRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string{}, r.order...)
+}
+
+func (r *StepRegistry) Get(name string) (step ProvisionStep, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	step, ok = r.steps[name]
+	return
+}
+
+func (r *StepRegistry) Enabled(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.steps[name]
+	return ok && !r.disabled[name]
+}
+
+// Steps return the enabled steps sorted by dependencies
+// Dependency on a disabled step is ignored, dependency on an unknown step is an error
+func (r *StepRegistry) Steps() ([]ProvisionStep, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	marks := make(map[string]int)
+	sorted := make([]ProvisionStep, 0, len(r.steps))
+	var visit func(name string, from string) error
+	visit = func(name string, from string) error {
+		step, ok := r.steps[name]
+		if !ok {
+			return fmt.Errorf("step %s depends on unknown step %s", from, name)
+		}
+		if r.disabled[name] {
+			return nil
+		}
+		switch marks[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle detected at step %s", name)
+		case visited:
+			return nil
+		}
+		marks[name] = visiting
+		for _, dep := range step.Depends() {
+			if err := visit(dep, name); err != nil {
+				return err
+			}
+		}
+		marks[name] = visited
+		sorted = append(sorted, step)
+		return nil
+	}
+	for _, name := range r.order {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// Run execute steps one by one, and stop at the first failure, so no step runs after its dependency failed
+func (r *StepRegistry) Run(d *ProvisionDevice) (report *ProvisionReport, err error) {
+	report = &ProvisionReport{
+		Serial:    d.Serial,
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartedAt)
+		report.Preflight = d.Preflight
+		if err != nil {
+			report.Error = err.Error()
+		}
+		provisionReports.Set(report)
+	}()
+
+	steps, err := r.Steps()
+	if err != nil {
+		return report, err
+	}
+	for _, step := range steps {
+		if err = d.Ctx.Err(); err != nil {
+			return report, errors.Wrap(err, "provision")
+		}
+		result := runStep(step, d)
+		report.Steps = append(report.Steps, result)
+		if result.Status == STEP_FAILURE {
+			return report, errors.Wrap(result.err, step.Name())
+		}
+	}
+	return report, nil
+}
+
+func runStep(step ProvisionStep, d *ProvisionDevice) (result StepResult) {
+	result = StepResult{
+		Name:      step.Name(),
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		result.Duration = time.Since(result.StartedAt)
+		log.Infof("%s step %s %s, took %v", d.Serial, result.Name, result.Status, result.Duration)
+		metricStepDuration.Observe(result.Duration.Seconds(), result.Name, result.Status)
+		transcripts.Record(d.Serial, TranscriptEntry{
+			Type:     TRANSCRIPT_STEP,
+			Step:     result.Name,
+			Status:   result.Status,
+			Error:    result.Error,
+			Duration: result.Duration,
+		})
+	}()
+	if !step.ShouldRun(d) {
+		result.Status = STEP_SKIPPED
+		return
+	}
+	log.Infof("%s process %s", d.Serial, step.Name())
+	if err := step.Run(d); err != nil {
+		result.Status = STEP_FAILURE
+		result.Error = err.Error()
+		result.err = err
+		return
+	}
+	result.Status = STEP_SUCCESS
+	return
+}
+
+// FuncStep make a ProvisionStep from functions, useful for simple steps
+type FuncStep struct {
+	StepName  string
+	DependsOn []string
+	Check     func(d *ProvisionDevice) bool // nil means always run
+	Do        func(d *ProvisionDevice) error
+	Undo      func(d *ProvisionDevice, r *DeprovisionReport) // nil means nothing to remove
+	DryRun    func(d *ProvisionDevice) []PlanItem            // nil means decided by Check
+}
+
+func (s *FuncStep) Name() string      { return s.StepName }
+func (s *FuncStep) Depends() []string { return s.DependsOn }
+
+func (s *FuncStep) ShouldRun(d *ProvisionDevice) bool {
+	if s.Check == nil {
+		return true
+	}
+	return s.Check(d)
+}
+
+func (s *FuncStep) Run(d *ProvisionDevice) error {
+	return s.Do(d)
+}
+
+func (s *FuncStep) Deprovision(d *ProvisionDevice, r *DeprovisionReport) {
+	if s.Undo != nil {
+		s.Undo(d, r)
+	}
+}
+
+func (s *FuncStep) Plan(d *ProvisionDevice) []PlanItem {
+	if s.DryRun == nil {
+		return defaultPlan(s, d)
+	}
+	return s.DryRun(d)
+}
+
+// PushFileStep push a local file to device, for extra binaries or config files
+// Src is relative to resourcesDir if not absolute
+type PushFileStep struct {
+	StepName  string
+	DependsOn []string
+	Src       string
+	Dst       string
+	Mode      os.FileMode
+}
+
+func (s *PushFileStep) Name() string      { return s.StepName }
+func (s *PushFileStep) Depends() []string { return s.DependsOn }
+
+func (s *PushFileStep) ShouldRun(d *ProvisionDevice) bool {
+	return true
+}
+
+func (s *PushFileStep) Run(d *ProvisionDevice) error {
+	src := s.Src
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(resourcesDir, src)
+	}
+	return writeFileToDeviceContext(d.Ctx, d.Device, src, s.Dst, s.Mode)
+}
+
+func (s *PushFileStep) Deprovision(d *ProvisionDevice, r *DeprovisionReport) {
+	r.RemoveFile(d.Device, s.Dst)
+}
+
+func (s *PushFileStep) Plan(d *ProvisionDevice) []PlanItem {
+	item := PlanItem{Step: s.StepName, Component: s.StepName, Action: PLAN_INSTALL, Reason: "push " + s.Src + " to " + s.Dst}
+	if _, err := d.Device.Stat(s.Dst); err == nil {
+		item.Action = PLAN_UPGRADE
+		item.Reason = s.Dst + " exists, always pushed"
+	}
+	return []PlanItem{item}
+}
+
+// ReportStore keeps the latest provision report of each device
+type ReportStore struct {
+	mu      sync.Mutex
+	reports map[string]*ProvisionReport
+}
+
+func (s *ReportStore) Set(report *ProvisionReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reports == nil {
+		s.reports = make(map[string]*ProvisionReport)
+	}
+	s.reports[report.Serial] = report
+}
+
+func (s *ReportStore) Get(serial string) (report *ProvisionReport, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report, ok = s.reports[serial]
+	return
+}
+
+func (s *ReportStore) All() []*ProvisionReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reports := make([]*ProvisionReport, 0, len(s.reports))
+	for _, r := range s.reports {
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Serial < reports[j].Serial
+	})
+	return reports
+}
+
+var provisionSteps = NewStepRegistry()
+var provisionReports = &ReportStore{}
+
+// RegisterProvisionStep add custom step, call it in init() of your own file
+func RegisterProvisionStep(step ProvisionStep) {
+	provisionSteps.Register(step)
+}
+
+func init() {
+	RegisterProvisionStep(&FuncStep{
+		StepName: "preflight",
+		Do: func(d *ProvisionDevice) error {
+			d.Preflight = preflight(d)
+			return d.Preflight.Error()
+		},
+	})
+	RegisterProvisionStep(&FuncStep{
+		StepName:  "minitools",
+		DependsOn: []string{"preflight"},
+		Do: func(d *ProvisionDevice) error {
+			return errors.Wrap(initSTFMiniTools(d.Ctx, d), "mini(cap|touch)")
+		},
+		DryRun: planMiniTools,
+		Undo: func(d *ProvisionDevice, r *DeprovisionReport) {
+			for _, name := range []string{"minicap", "minicap.so", "minitouch"} {
+				r.RemoveFile(d.Device, "/data/local/tmp/"+name)
+			}
+		},
+	})
+	RegisterProvisionStep(&FuncStep{
+		StepName:  "atx-agent",
+		DependsOn: []string{"preflight"},
+		Do: func(d *ProvisionDevice) error {
+			return d.Keeper.processAgent()
+		},
+		DryRun: func(d *ProvisionDevice) []PlanItem {
+			return []PlanItem{d.Keeper.planAgent()}
+		},
+		Undo: func(d *ProvisionDevice, r *DeprovisionReport) {
+			d.Keeper.deprovisionAgent(r)
+		},
+	})
+	RegisterProvisionStep(&FuncStep{
+		StepName:  "uiautomator",
+		DependsOn: []string{"atx-agent"},
+		Do: func(d *ProvisionDevice) error {
+			return d.Keeper.processUiautomator()
+		},
+		DryRun: func(d *ProvisionDevice) []PlanItem {
+			return d.Keeper.planUiautomator()
+		},
+		Undo: func(d *ProvisionDevice, r *DeprovisionReport) {
+			r.UninstallPackage(d.Device, d.Keeper.UiautomatorTest.Package)
+			r.UninstallPackage(d.Device, d.Keeper.Uiautomator.Package)
+		},
+	})
+	RegisterProvisionStep(&FuncStep{
+		StepName:  "device-policy",
+		DependsOn: []string{"uiautomator"},
+		Check: func(d *ProvisionDevice) bool {
+			return len(manifest.Policy.Settings()) > 0
+		},
+		Do: func(d *ProvisionDevice) error {
+			d.PolicyDrift = applyPolicy(d.Device, manifest.Policy)
+			for _, drift := range d.PolicyDrift {
+				log.Warnf("%s policy not applied, %s", d.Serial, drift)
+			}
+			return nil
+		},
+		DryRun: planPolicy,
+	})
+	RegisterProvisionStep(&FuncStep{
+		StepName: "record-apk",
+		Do: func(d *ProvisionDevice) error {
+			return d.Keeper.processRecordAPK()
+		},
+		DryRun: func(d *ProvisionDevice) []PlanItem {
+			return []PlanItem{d.Keeper.planRecordAPK()}
+		},
+		Undo: func(d *ProvisionDevice, r *DeprovisionReport) {
+			r.UninstallPackage(d.Device, d.Keeper.Recorder.Package)
+		},
+	})
+	// record apk is not needed by default
+	provisionSteps.Disable("record-apk")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func newTestStep(name string, depends ...string) ProvisionStep {
+	return &FuncStep{
+		StepName:  name,
+		DependsOn: depends,
+		Do:        func(d *ProvisionDevice) error { return nil },
+	}
+}
+
+func stepNames(steps []ProvisionStep) []string {
+	names := make([]string, 0, len(steps))
+	for _, s := range steps {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+func TestStepRegistryOrder(t *testing.T) {
+	r := NewStepRegistry()
+	r.Register(newTestStep("c", "b"))
+	r.Register(newTestStep("a"))
+	r.Register(newTestStep("b", "a"))
+	steps, err := r.Steps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stepNames(steps); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Fatalf("expect [a b c], got %v", got)
+	}
+
+	if err := r.Disable("b"); err != nil {
+		t.Fatal(err)
+	}
+	steps, _ = r.Steps()
+	if got := stepNames(steps); len(got) != 2 || got[0] != "c" || got[1] != "a" {
+		t.Fatalf("expect [c a], got %v", got)
+	}
+
+	if err := r.SetOrder([]string{"a", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	steps, _ = r.Steps()
+	if got := stepNames(steps); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Fatalf("expect [a c], got %v", got)
+	}
+}
+
+func TestStepRegistryCycle(t *testing.T) {
+	r := NewStepRegistry()
+	r.Register(newTestStep("a", "b"))
+	r.Register(newTestStep("b", "a"))
+	if _, err := r.Steps(); err == nil {
+		t.Fatal("expect dependency cycle error")
+	}
+	r.Register(newTestStep("c", "unknown"))
+	r.Disable("a")
+	if _, err := r.Steps(); err == nil {
+		t.Fatal("expect unknown dependency error")
+	}
+}
+
+func TestStepRegistryRunError(t *testing.T) {
+	r := NewStepRegistry()
+	ran := false
+	r.Register(&FuncStep{
+		StepName: "a",
+		Do: func(d *ProvisionDevice) error {
+			return &ChecksumError{File: "atx-agent.tar.gz", Expect: "00", Got: "ff"}
+		},
+	})
+	r.Register(&FuncStep{
+		StepName:  "b",
+		DependsOn: []string{"a"},
+		Do:        func(d *ProvisionDevice) error { ran = true; return nil },
+	})
+	report, err := r.Run(&ProvisionDevice{Ctx: context.Background(), Serial: "test-run-error"})
+	if _, ok := errors.Cause(err).(*ChecksumError); !ok {
+		t.Fatalf("expect ChecksumError, got %#v", err)
+	}
+	if ran || len(report.Steps) != 1 {
+		t.Errorf("step b should not run after a failed, got %v", report.Steps)
+	}
+}
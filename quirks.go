@@ -0,0 +1,136 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+const (
+	defaultTmpDir = "/sdcard/tmp"
+)
+
+var defaultInstallArgs = []string{"-r", "-t"}
+
+// Quirk is vendor specific handling, matched by ro.product.manufacturer and ro.build.display.id (glob pattern supported)
+// Empty fields keep the value of quirks matched before
+type Quirk struct {
+	Name         string   `json:"name" yaml:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty" yaml:"manufacturer,omitempty"`
+	Display      string   `json:"display,omitempty" yaml:"display,omitempty"`
+	TmpDir       string   `json:"tmpDir,omitempty" yaml:"tmpDir,omitempty"`           // apks are pushed here before install
+	AgentDir     string   `json:"agentDir,omitempty" yaml:"agentDir,omitempty"`       // where atx-agent lives
+	InstallArgs  []string `json:"installArgs,omitempty" yaml:"installArgs,omitempty"` // pm install flags
+	Setup        []string `json:"setup,omitempty" yaml:"setup,omitempty"`             // shell commands run before install
+}
+
+func (q *Quirk) Match(props map[string]string) bool {
+	return globMatch(q.Manufacturer, props["ro.product.manufacturer"]) &&
+		globMatch(q.Display, props["ro.build.display.id"])
+}
+
+func (q *Quirk) apply(o *Quirk) {
+	if q.Name == "" {
+		q.Name = o.Name
+	} else {
+		q.Name += "," + o.Name
+	}
+	if o.TmpDir != "" {
+		q.TmpDir = o.TmpDir
+	}
+	if o.AgentDir != "" {
+		q.AgentDir = o.AgentDir
+	}
+	if len(o.InstallArgs) > 0 {
+		q.InstallArgs = o.InstallArgs
+	}
+	q.Setup = append(q.Setup, o.Setup...)
+}
+
+// InstallCommand return pm install command of apk in device
+func (q Quirk) InstallCommand(dstPath string) []string {
+	args := append([]string{"install"}, q.InstallArgs...)
+	return append(args, dstPath)
+}
+
+// RunSetup run setup commands, errors are ignored since not all commands work on every ROM version
+func (q Quirk) RunSetup(device *goadb.Device) {
+	for _, cmd := range q.Setup {
+		output, err := runCommand(device, "sh", "-c", cmd)
+		if err != nil {
+			log.Warnf("quirk %s setup %q: %v", q.Name, cmd, err)
+			continue
+		}
+		log.Debugf("quirk %s setup %q: %s", q.Name, cmd, strings.TrimSpace(output))
+	}
+}
+
+var builtinQuirks = []*Quirk{
+	{
+		// Nubia can only work in /data/data/com.android.shell
+		Name:         "nubia",
+		Manufacturer: "nubia",
+		AgentDir:     "/data/data/com.android.shell",
+	},
+	{
+		// "USB install" in developer options need a Mi account, can not be turned on through adb
+		Name:         "xiaomi",
+		Manufacturer: "xiaomi",
+		Setup: []string{
+			"settings put global verifier_verify_adb_installs 0",
+			"settings put global package_verifier_enable 0",
+		},
+	},
+	{
+		Name:         "vivo",
+		Manufacturer: "vivo",
+		TmpDir:       "/data/local/tmp",
+	},
+	{
+		Name:         "oppo",
+		Manufacturer: "oppo",
+		TmpDir:       "/data/local/tmp",
+		Setup: []string{
+			"settings put global verifier_verify_adb_installs 0",
+		},
+	},
+	{
+		// uiautomator apk installed by other tools may have a higher version code
+		Name:         "huawei",
+		Manufacturer: "huawei",
+		InstallArgs:  []string{"-r", "-t", "-d"},
+	},
+}
+
+// resolveQuirk merge all matched quirks, builtin ones first, then the ones in manifest
+func resolveQuirk(props map[string]string) Quirk {
+	q := Quirk{
+		TmpDir:      defaultTmpDir,
+		InstallArgs: defaultInstallArgs,
+	}
+	for _, o := range append(append([]*Quirk{}, builtinQuirks...), manifest.Quirks...) {
+		if o.Match(props) {
+			q.apply(o)
+		}
+	}
+	return q
+}
+
+// deviceQuirk is used where props of device are not fetched yet
+func deviceQuirk(device *goadb.Device) Quirk {
+	props, err := device.Properties()
+	if err != nil {
+		return resolveQuirk(nil)
+	}
+	return resolveQuirk(props)
+}
+
+// agentPath move atx-agent into AgentDir of quirk
+func (q Quirk) agentPath(devicePath string) string {
+	if q.AgentDir == "" {
+		return devicePath
+	}
+	return path.Join(q.AgentDir, path.Base(devicePath))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveQuirk(t *testing.T) {
+	q := resolveQuirk(map[string]string{"ro.product.manufacturer": "Google"})
+	if q.Name != "" || q.TmpDir != defaultTmpDir || !reflect.DeepEqual(q.InstallArgs, defaultInstallArgs) {
+		t.Errorf("expect default quirk, got %+v", q)
+	}
+
+	defer func(quirks []*Quirk) { manifest.Quirks = quirks }(manifest.Quirks)
+	manifest.Quirks = []*Quirk{
+		{Name: "miui9", Manufacturer: "xiaomi", Display: "*V9.*", TmpDir: "/data/local/tmp"},
+	}
+	q = resolveQuirk(map[string]string{"ro.product.manufacturer": "Xiaomi", "ro.build.display.id": "MIUI V9.5.4"})
+	if q.Name != "xiaomi,miui9" {
+		t.Errorf("expect quirk xiaomi,miui9, got %s", q.Name)
+	}
+	if q.TmpDir != "/data/local/tmp" || len(q.Setup) != 2 {
+		t.Errorf("quirks not merged: %+v", q)
+	}
+	if got := q.InstallCommand("/data/local/tmp/a.apk"); !reflect.DeepEqual(got, []string{"install", "-r", "-t", "/data/local/tmp/a.apk"}) {
+		t.Errorf("unexpected install command %v", got)
+	}
+}
+
+func TestQuirkAgentPath(t *testing.T) {
+	q := resolveQuirk(map[string]string{"ro.product.manufacturer": "nubia"})
+	if p := q.agentPath("/data/local/tmp/atx-agent"); p != "/data/data/com.android.shell/atx-agent" {
+		t.Errorf("unexpected agent path %s", p)
+	}
+}
+
+func TestPartialFileDirs(t *testing.T) {
+	q := resolveQuirk(map[string]string{"ro.product.manufacturer": "nubia"})
+	expect := []string{"/data/local/tmp", "/sdcard/tmp", "/data/data/com.android.shell"}
+	if dirs := partialFileDirs(q); !reflect.DeepEqual(dirs, expect) {
+		t.Errorf("expect %v, got %v", expect, dirs)
+	}
+}
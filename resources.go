@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/qiniu/log"
+)
+
+// Resource status reported by resources verify
+const (
+	RESOURCE_OK         = "ok"
+	RESOURCE_MISSING    = "missing"
+	RESOURCE_MISMATCH   = "mismatch"
+	RESOURCE_UNVERIFIED = "unverified" // no checksum in manifest
+	RESOURCE_ERROR      = "error"
+)
+
+// verifyResource check the downloaded file of component against its checksum
+func verifyResource(c *Component) (status string, err error) {
+	localPath := c.LocalPath()
+	if !fileExists(localPath) {
+		return RESOURCE_MISSING, nil
+	}
+	checksum, err := c.ExpectedChecksum()
+	if err != nil {
+		return RESOURCE_ERROR, err
+	}
+	if checksum == "" {
+		return RESOURCE_UNVERIFIED, nil
+	}
+	if err = verifyFile(localPath, checksum); err != nil {
+		if _, ok := err.(*ChecksumError); ok {
+			return RESOURCE_MISMATCH, err
+		}
+		return RESOURCE_ERROR, err
+	}
+	return RESOURCE_OK, nil
+}
+
+// pruneResources remove files and dirs of components which are not referenced by manifest
+// Files not belong to any component (eg: adb, quarantine) are kept
+func pruneResources(dryRun bool) (removed []string, err error) {
+	keep := make(map[string]bool)
+	names := make([]string, 0)
+	for _, c := range manifest.Resources() {
+		keep[filepath.Base(c.LocalPath())] = true
+		switch c.Install {
+		case INSTALL_ZIP, INSTALL_TARGZ:
+			// dirs extracted from older archives of the same version are removed
+			if sum, err := cachedFileSHA256(c.LocalPath()); err == nil {
+				keep[filepath.Base(extractDir(c.LocalPath(), sum))] = true
+			} else if c.Install == INSTALL_ZIP {
+				keep[c.baseName()] = true // unpacked by hand
+			}
+		}
+		if !containsString(names, c.Name) {
+			names = append(names, c.Name)
+		}
+	}
+	infos, err := ioutil.ReadDir(resourcesDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if keep[info.Name()] || !isComponentFile(names, info.Name()) {
+			continue
+		}
+		if !dryRun {
+			if err = removeResource(filepath.Join(resourcesDir, info.Name())); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, info.Name())
+	}
+	if !dryRun && len(removed) > 0 {
+		err = removeLocalChecksums(removed)
+	}
+	return removed, err
+}
+
+// removeResource wait for readers of path before removing it
+func removeResource(path string) error {
+	unlock, err := lockResource(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.RemoveAll(path)
+}
+
+// isComponentFile return true if filename looks like ${NAME}-${VERSION}...
+func isComponentFile(names []string, filename string) bool {
+	for _, name := range names {
+		rest := strings.TrimPrefix(filename, name+"-")
+		if rest != filename && rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchResource download component and verify it, the checksum is saved in SHA256SUMS by Fetch
+func fetchResource(c *Component) (localPath string, status string, err error) {
+	if localPath, err = c.Fetch(); err != nil {
+		return "", RESOURCE_ERROR, err
+	}
+	status, err = verifyResource(c)
+	return localPath, status, err
+}
+
+func runResourcesFetch() {
+	failed := false
+	for _, c := range manifest.Resources() {
+		localPath, status, err := fetchResource(c)
+		if err != nil {
+			failed = true
+			fmt.Printf("error %s %s %s: %v\n", c.Name, c.Version, c.Arch, err)
+			continue
+		}
+		fmt.Println("fetched", localPath, status)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runResourcesVerify() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tVERSION\tARCH\tFILE\tSTATUS\tERROR")
+	failed := false
+	for _, c := range manifest.Resources() {
+		status, err := verifyResource(c)
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		switch status {
+		case RESOURCE_MISSING, RESOURCE_MISMATCH, RESOURCE_ERROR:
+			failed = true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Name, c.Version, c.Arch, filepath.Base(c.LocalPath()), status, errMsg)
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func runResourcesList() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tVERSION\tARCH\tFILE\tSTATUS")
+	for _, c := range manifest.Resources() {
+		status := "present"
+		if !fileExists(c.LocalPath()) {
+			status = RESOURCE_MISSING
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Name, c.Version, c.Arch, filepath.Base(c.LocalPath()), status)
+	}
+	w.Flush()
+	fmt.Println()
+
+	abis := make([]string, 0, len(abiArchs))
+	for abi := range abiArchs {
+		abis = append(abis, abi)
+	}
+	sort.Strings(abis)
+	agent := manifest.Resolve("atx-agent", nil)
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ABI\tATX-AGENT\tMINITOUCH\tMINICAP SDK")
+	for _, abi := range abis {
+		agentArch := RESOURCE_MISSING
+		for _, arch := range abiArchs[abi] {
+			agent.Arch = arch
+			if fileExists(agent.LocalPath()) {
+				agentArch = agent.Version + " " + arch
+				break
+			}
+		}
+		minitouch := "present"
+		if _, err := minitouchPrebuilt([]string{abi}); err != nil {
+			minitouch = RESOURCE_MISSING
+		}
+		sdks := availableMinicapSdks([]string{abi})
+		sort.Slice(sdks, func(i, j int) bool {
+			a, _ := strconv.Atoi(sdks[i])
+			b, _ := strconv.Atoi(sdks[j])
+			return a < b
+		})
+		minicap := strings.Join(sdks, ",")
+		if minicap == "" {
+			minicap = RESOURCE_MISSING
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", abi, agentArch, minitouch, minicap)
+	}
+	w.Flush()
+}
+
+func runResourcesPrune(dryRun bool) {
+	removed, err := pruneResources(dryRun)
+	for _, name := range removed {
+		if dryRun {
+			fmt.Println("would remove", name)
+		} else {
+			fmt.Println("removed", name)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIsComponentFile(t *testing.T) {
+	names := []string{"atx-agent", "app-uiautomator"}
+	tests := map[string]bool{
+		"atx-agent-0.4.9-armv7.tar.gz":   true,
+		"atx-agent-0.4.9-armv7":          true,
+		"app-uiautomator-1.1.5.apk":      true,
+		"app-uiautomator-test-1.1.5.apk": false,
+		"quarantine":                     false,
+		"SHA256SUMS":                     false,
+		"adb":                            false,
+	}
+	for filename, expect := range tests {
+		if got := isComponentFile(names, filename); got != expect {
+			t.Errorf("isComponentFile(%s) expect %v, got %v", filename, expect, got)
+		}
+	}
+}
+
+func TestPruneResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resourcesDir = old }(resourcesDir)
+	resourcesDir = dir
+
+	for _, name := range []string{"atx-agent-0.4.9-armv7.tar.gz", "atx-agent-0.5.1-armv7.tar.gz", "app-uiautomator-1.1.5.apk", "stf-binaries-0.2.zip", "adb"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	// sha256 of empty file is e3b0c44298fc...
+	os.Mkdir(filepath.Join(dir, "atx-agent-0.4.9-armv7@e3b0c44298fc"), 0755)
+	os.Mkdir(filepath.Join(dir, "atx-agent-0.5.1-armv7@000000000000"), 0755)
+	os.Mkdir(filepath.Join(dir, "atx-agent-0.5.1-armv7@e3b0c44298fc"), 0755)
+	os.Mkdir(filepath.Join(dir, "stf-binaries-0.2"), 0755)
+	os.Mkdir(filepath.Join(dir, "stf-binaries-0.2@e3b0c44298fc"), 0755)
+
+	empty := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	saveLocalChecksums(map[string]string{"atx-agent-0.4.9-armv7.tar.gz": empty, "atx-agent-0.5.1-armv7.tar.gz": empty})
+
+	removed, err := pruneResources(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(dir, "atx-agent-0.4.9-armv7@e3b0c44298fc")) {
+		t.Fatal("dry run should not remove files")
+	}
+	if _, err = pruneResources(false); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(removed)
+	expect := []string{"app-uiautomator-1.1.5.apk", "atx-agent-0.4.9-armv7.tar.gz", "atx-agent-0.4.9-armv7@e3b0c44298fc", "atx-agent-0.5.1-armv7@000000000000", "stf-binaries-0.2"}
+	if !reflect.DeepEqual(removed, expect) {
+		t.Errorf("expect %v removed, got %v", expect, removed)
+	}
+	if expect := map[string]string{"atx-agent-0.5.1-armv7.tar.gz": empty}; !reflect.DeepEqual(readLocalChecksums(), expect) {
+		t.Errorf("checksums of removed files should be removed, expect %v, got %v", expect, readLocalChecksums())
+	}
+	for _, name := range []string{"atx-agent-0.5.1-armv7.tar.gz", "atx-agent-0.5.1-armv7@e3b0c44298fc", "stf-binaries-0.2.zip", "stf-binaries-0.2@e3b0c44298fc", "adb", ".locks"} {
+		if !fileExists(filepath.Join(dir, name)) {
+			t.Errorf("%s should be kept", name)
+		}
+	}
+}
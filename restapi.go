@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
@@ -58,11 +60,23 @@ func renderJSONSuccess(w http.ResponseWriter, v interface{}) {
 }
 
 type ADevice struct {
-	Serial    string `json:"serial"`
-	Model     string `json:"model"`
-	Product   string `json:"product"`
-	Udid      string `json:"udid"`
-	AgentPort int    `json:"agentPort"`
+	Serial       string           `json:"serial"`
+	Model        string           `json:"model"`
+	Product      string           `json:"product"`
+	Udid         string           `json:"udid"`
+	AgentPort    int              `json:"agentPort"`
+	Capabilities Capabilities     `json:"capabilities"`
+	State        string           `json:"state"`
+	LastError    string           `json:"lastError,omitempty"`
+	Hint         string           `json:"hint,omitempty"` // what operator should do when device can not be used
+	Attempts     int              `json:"attempts"`
+	NextRetryAt  *time.Time       `json:"nextRetryAt,omitempty"`
+	Health       *HealthRecord    `json:"health,omitempty"`
+	PolicyDrift  []string         `json:"policyDrift,omitempty"`
+	Preflight    *PreflightResult `json:"preflight,omitempty"`
+	UpdatedAt    time.Time        `json:"updatedAt"`
+
+	retryTimer *time.Timer // scheduled init after failure
 }
 
 type InstallInfo struct {
@@ -82,16 +96,22 @@ type PackageManager struct {
 }
 
 func newPackageManager() *PackageManager {
+	dmer := flashget.NewDownloadManager()
+	dmer.Sources = flashgetSources
+	dmer.OnSourceResult = flashgetSourceResult
+	dmer.OnCacheHit = func(url string) { metricFlashgetCacheHits.Inc() }
+	dmer.OnCacheMiss = func(url string) { metricFlashgetCacheMisses.Inc() }
+	dmer.Quarantine = quarantine
 	return &PackageManager{
 		downloads: make(map[string]*InstallInfo),
-		dmer:      flashget.NewDownloadManager(),
+		dmer:      dmer,
 	}
 }
 
 // func (pm *PackageManager) PushFromUrl(serial, url string) ()
-func (pm *PackageManager) handleAPKFromUrl(serial, url string, noInstall bool) (info InstallInfo, err error) {
+func (pm *PackageManager) handleAPKFromUrl(serial, url, checksum string, noInstall bool) (info InstallInfo, err error) {
 	id := UniqID()
-	dl, err := pm.dmer.Retrive(url)
+	dl, err := pm.dmer.RetriveWithChecksum(url, checksum)
 	if err != nil {
 		return
 	}
@@ -106,6 +126,7 @@ func (pm *PackageManager) handleAPKFromUrl(serial, url string, noInstall bool) (
 	}
 	pm.downloads[id] = insInfo
 	go func() {
+		defer func() { metricInstalls.Inc(insInfo.Status) }()
 		dl.Wait()
 		if !dl.Finished() {
 			insInfo.Status = PACKAGE_FAILURE
@@ -120,7 +141,8 @@ func (pm *PackageManager) handleAPKFromUrl(serial, url string, noInstall bool) (
 			insInfo.Description = "open file " + dl.Filename + " error: " + er.Error()
 			return
 		}
-		dstFilepath := fmt.Sprintf("/sdcard/tmp/u2init-%s.apk", id)
+		quirk := deviceQuirk(d)
+		dstFilepath := path.Join(quirk.TmpDir, fmt.Sprintf("u2init-%s.apk", id))
 		insInfo.Status = PACKAGE_PUSHING
 		insInfo.PushBeganAt = time.Now()
 		insInfo.DeviceFilePath = dstFilepath
@@ -139,7 +161,8 @@ func (pm *PackageManager) handleAPKFromUrl(serial, url string, noInstall bool) (
 		}
 
 		insInfo.Status = PACKAGE_INSTALL
-		output, er := d.RunTimeoutCommand(time.Minute*5, "pm", "install", "-r", "-t", dstFilepath)
+		quirk.RunSetup(d)
+		output, er := runTimeoutCommand(d, time.Minute*5, "pm", quirk.InstallCommand(dstFilepath)...)
 		if er != nil {
 			insInfo.Description = "pm install error: " + er.Error()
 			insInfo.Status = PACKAGE_FAILURE
@@ -156,6 +179,9 @@ func (pm *PackageManager) handleAPKFromUrl(serial, url string, noInstall bool) (
 	return *pm.downloads[id], nil
 }
 
+// packageManager is used by REST API, created in init
+var packageManager *PackageManager
+
 func (pm *PackageManager) Get(id string) (info InstallInfo, err error) {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
@@ -175,6 +201,7 @@ func init() {
 	router := mux.NewRouter()
 	pm := newPackageManager()
 	pm.dmer.EnableAutoRecycle()
+	packageManager = pm
 
 	// Note, use router.HandleFunc will redirect /devices to /devices/
 	http.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
@@ -195,10 +222,136 @@ func init() {
 		renderJSONSuccess(w, d)
 	})
 
+	router.HandleFunc("/devices/{serial}/provision", func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		report, ok := provisionReports.Get(serial)
+		if !ok {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": fmt.Sprintf("serial %s never provisioned", serial),
+			}, 404)
+			return
+		}
+		renderJSONSuccess(w, report)
+	}).Methods("GET")
+
+	router.HandleFunc("/devices/{serial}/provision", func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		if lifecycle == nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "u2init is not watching devices",
+			}, 500)
+			return
+		}
+		report, err := lifecycle.Deprovision(serial)
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "deprovision: " + err.Error(),
+			}, 500)
+			return
+		}
+		renderJSONSuccess(w, report)
+	}).Methods("DELETE")
+
+	router.HandleFunc("/devices/{serial}/provision/history", func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		history, err := transcripts.History(serial)
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "history: " + err.Error(),
+			}, 500)
+			return
+		}
+		renderJSONSuccess(w, history)
+	}).Methods("GET")
+
+	router.HandleFunc("/devices/{serial}/provision/history/{id}", func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		entries, err := transcripts.Get(vars["serial"], vars["id"])
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "transcript: " + err.Error(),
+			}, 404)
+			return
+		}
+		renderJSONSuccess(w, entries)
+	}).Methods("GET")
+
+	router.HandleFunc("/devices/{serial}/pins", func(w http.ResponseWriter, r *http.Request) {
+		renderJSONSuccess(w, pins.Get(mux.Vars(r)["serial"]))
+	}).Methods("GET")
+
+	router.HandleFunc("/devices/{serial}/pins", func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		p := make(Pins)
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "invalid pins: " + err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		if err := pins.Set(serial, p); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "pins: " + err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		// apply pins now if device is connected
+		if d, ok := dm.Get(serial); ok && lifecycle != nil && !unavailable(d.State) && d.State != DEVICE_DEPROVISIONED {
+			lifecycle.Online(serial)
+		}
+		renderJSONSuccess(w, pins.Get(serial))
+	}).Methods("PUT")
+
+	router.HandleFunc("/devices/{serial}/plan", func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		serverAddr := ""
+		if lifecycle != nil {
+			serverAddr = lifecycle.ServerAddr
+		}
+		device := adb.Device(goadb.DeviceWithSerial(serial))
+		pd, err := newProvisionDevice(context.Background(), device, serverAddr)
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "device error: " + err.Error(),
+			}, 500)
+			return
+		}
+		plan, err := planDevice(pd)
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "plan: " + err.Error(),
+			}, 500)
+			return
+		}
+		renderJSONSuccess(w, plan)
+	}).Methods("GET")
+
+	router.HandleFunc("/devices/{serial}/health", func(w http.ResponseWriter, r *http.Request) {
+		serial := mux.Vars(r)["serial"]
+		if _, ok := dm.Get(serial); !ok {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": fmt.Sprintf("serial %s not found", serial),
+			}, 404)
+			return
+		}
+		renderJSONSuccess(w, healthChecker.History(serial))
+	}).Methods("GET")
+
 	router.HandleFunc("/devices/{serial}/pkgs", func(w http.ResponseWriter, r *http.Request) {
 		// check params
 		serial := mux.Vars(r)["serial"]
 		url := r.FormValue("url")
+		checksum := r.FormValue("sha256")
 		noInstall := strings.ToLower(r.FormValue("noInstall")) == "true"
 		if url == "" {
 			renderJSON(w, map[string]interface{}{
@@ -220,7 +373,7 @@ func init() {
 		}
 
 		// call download manager to download file
-		insInfo, err := pm.handleAPKFromUrl(serial, url, noInstall)
+		insInfo, err := pm.handleAPKFromUrl(serial, url, checksum, noInstall)
 		if err != nil {
 			renderJSON(w, map[string]interface{}{
 				"success":     false,
@@ -273,5 +426,69 @@ func init() {
 			})
 		}).Methods("GET")
 
+	router.HandleFunc("/mirrors", func(w http.ResponseWriter, r *http.Request) {
+		renderJSONSuccess(w, mirrorHealth.Stats(globalMirrors()))
+	}).Methods("GET")
+
+	router.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		renderJSONSuccess(w, peerHealth.Stats(peers.All()))
+	}).Methods("GET")
+
+	router.HandleFunc("/rollout", func(w http.ResponseWriter, r *http.Request) {
+		rollout, ok := rollouts.Current()
+		if !ok {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "no rollout yet",
+			}, 404)
+			return
+		}
+		renderJSONSuccess(w, rollout)
+	}).Methods("GET")
+
+	router.HandleFunc("/rollout", func(w http.ResponseWriter, r *http.Request) {
+		var cfg RolloutConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "invalid rollout: " + err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		if lifecycle == nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "u2init is not watching devices",
+			}, 500)
+			return
+		}
+		rollout, err := rollouts.Start(lifecycle, cfg)
+		if err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": "rollout: " + err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		renderJSONSuccess(w, rollout)
+	}).Methods("POST")
+
+	router.HandleFunc("/rollout", func(w http.ResponseWriter, r *http.Request) {
+		if err := rollouts.Abort(); err != nil {
+			renderJSON(w, map[string]interface{}{
+				"success":     false,
+				"description": err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		renderJSON(w, map[string]interface{}{
+			"success":     true,
+			"description": "rollout aborted, upgraded devices will be rolled back",
+		})
+	}).Methods("DELETE")
+
 	http.Handle("/devices/", router)
+	http.Handle("/rollout", router)
+	http.Handle("/mirrors", router)
+	http.Handle("/peers", router)
 }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// Rollout states
+const (
+	ROLLOUT_RUNNING   = "running"
+	ROLLOUT_SUCCEEDED = "succeeded"
+	ROLLOUT_HALTED    = "halted" // failure rate exceeded threshold, upgraded devices rolled back
+	ROLLOUT_ABORTED   = "aborted"
+)
+
+// Device states in a rollout
+const (
+	ROLLOUT_PENDING     = "pending"
+	ROLLOUT_UPGRADING   = "upgrading"
+	ROLLOUT_UPGRADED    = "upgraded"
+	ROLLOUT_FAILED      = "failed" // rolled back immediately
+	ROLLOUT_ROLLED_BACK = "rolled-back"
+	ROLLOUT_SKIPPED     = "skipped" // went offline before upgraded
+)
+
+const (
+	agentBackupSuffix = ".prev"
+	agentCheckTimeout = 15 * time.Second
+)
+
+// RolloutConfig is the body of POST /rollout
+type RolloutConfig struct {
+	Version          string   `json:"version"`
+	CanaryPercent    int      `json:"canaryPercent"`     // devices in the first batch, default 10
+	BatchSize        int      `json:"batchSize"`         // default 5
+	Pause            string   `json:"pause"`             // wait between batches, default 1m
+	FailureThreshold *float64 `json:"failureThreshold"`  // 0-1, halt when failed/finished exceeds it, default 0.2, 0 halts on the first failure
+	Serials          []string `json:"serials,omitempty"` // default all ready devices
+}
+
+func (c *RolloutConfig) setDefaults() (pause time.Duration, err error) {
+	if c.Version == "" {
+		return 0, errors.New("version is required")
+	}
+	if c.CanaryPercent == 0 {
+		c.CanaryPercent = 10
+	}
+	if c.CanaryPercent < 0 || c.CanaryPercent > 100 {
+		return 0, fmt.Errorf("canaryPercent must be in 1-100, got %d", c.CanaryPercent)
+	}
+	if c.BatchSize <= 0 {
+		c.BatchSize = 5
+	}
+	if c.Pause == "" {
+		c.Pause = "1m"
+	}
+	if pause, err = time.ParseDuration(c.Pause); err != nil {
+		return 0, errors.Wrap(err, "pause")
+	}
+	if c.FailureThreshold == nil {
+		threshold := 0.2
+		c.FailureThreshold = &threshold
+	}
+	if *c.FailureThreshold < 0 || *c.FailureThreshold > 1 {
+		return 0, fmt.Errorf("failureThreshold must be in 0-1, got %v", *c.FailureThreshold)
+	}
+	return pause, nil
+}
+
+type RolloutDevice struct {
+	Serial string `json:"serial"`
+	Batch  int    `json:"batch"` // 0 is the canary batch
+	Status string `json:"status"`
+	From   string `json:"from,omitempty"` // version before upgrade
+	Error  string `json:"error,omitempty"`
+}
+
+// Rollout upgrade atx-agent of connected devices batch by batch
+type Rollout struct {
+	RolloutConfig
+	State      string           `json:"state"`
+	Batch      int              `json:"batch"` // current batch
+	Batches    int              `json:"batches"`
+	Devices    []*RolloutDevice `json:"devices"`
+	StartedAt  time.Time        `json:"startedAt"`
+	FinishedAt *time.Time       `json:"finishedAt,omitempty"`
+	Error      string           `json:"error,omitempty"`
+
+	pause  time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// splitBatches return batch number of each device, the first one is canary
+func splitBatches(n int, canaryPercent int, batchSize int) (batches []int, count int) {
+	canary := (n*canaryPercent + 99) / 100
+	if canary < 1 {
+		canary = 1
+	}
+	batches = make([]int, n)
+	for i := range batches {
+		if i < canary {
+			batches[i] = 0
+		} else {
+			batches[i] = 1 + (i-canary)/batchSize
+		}
+	}
+	if n > 0 {
+		count = batches[n-1] + 1
+	}
+	return
+}
+
+// RolloutManager run one rollout at a time
+type RolloutManager struct {
+	mu       sync.Mutex
+	current  *Rollout
+	upgraded map[string]string // serial -> version, used by newATXKeeper before the rollout finished
+}
+
+var rollouts = &RolloutManager{upgraded: make(map[string]string)}
+
+// AgentVersion return atx-agent version of device upgraded by the running rollout
+func (m *RolloutManager) AgentVersion(serial string) (version string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	version, ok = m.upgraded[serial]
+	return
+}
+
+// Current return a copy of the latest rollout
+func (m *RolloutManager) Current() (r Rollout, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == nil {
+		return
+	}
+	r = *m.current
+	r.Devices = make([]*RolloutDevice, 0, len(m.current.Devices))
+	for _, d := range m.current.Devices {
+		dc := *d
+		r.Devices = append(r.Devices, &dc)
+	}
+	return r, true
+}
+
+// Start a rollout to devices ready, devices with atx-agent pinned are not touched
+func (m *RolloutManager) Start(lc *Lifecycle, cfg RolloutConfig) (Rollout, error) {
+	pause, err := cfg.setDefaults()
+	if err != nil {
+		return Rollout{}, err
+	}
+	serials := make([]string, 0)
+	for _, d := range dm.All() {
+		if d.State != DEVICE_READY && d.State != DEVICE_DEGRADED {
+			continue
+		}
+		if len(cfg.Serials) > 0 && !containsString(cfg.Serials, d.Serial) {
+			continue
+		}
+		if _, pinned := pins.Get(d.Serial)["atx-agent"]; pinned {
+			continue
+		}
+		serials = append(serials, d.Serial)
+	}
+	if len(serials) == 0 {
+		return Rollout{}, errors.New("no ready device to upgrade")
+	}
+	sort.Strings(serials)
+
+	m.mu.Lock()
+	if m.current != nil && m.current.State == ROLLOUT_RUNNING {
+		m.mu.Unlock()
+		return Rollout{}, errors.New("another rollout is running")
+	}
+	r := &Rollout{
+		RolloutConfig: cfg,
+		State:         ROLLOUT_RUNNING,
+		StartedAt:     time.Now(),
+		pause:         pause,
+	}
+	batches, count := splitBatches(len(serials), cfg.CanaryPercent, cfg.BatchSize)
+	r.Batches = count
+	for i, serial := range serials {
+		r.Devices = append(r.Devices, &RolloutDevice{Serial: serial, Batch: batches[i], Status: ROLLOUT_PENDING})
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	m.current = r
+	m.mu.Unlock()
+
+	log.Infof("rollout atx-agent %s to %d devices in %d batches", cfg.Version, len(serials), count)
+	go m.run(lc, r)
+	rollout, _ := m.Current()
+	return rollout, nil
+}
+
+// Abort stop the running rollout, upgraded devices are rolled back
+func (m *RolloutManager) Abort() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current == nil || m.current.State != ROLLOUT_RUNNING {
+		return errors.New("no rollout is running")
+	}
+	m.current.cancel()
+	return nil
+}
+
+func (m *RolloutManager) run(lc *Lifecycle, r *Rollout) {
+	for batch := 0; batch < r.Batches; batch++ {
+		if batch > 0 {
+			select {
+			case <-time.After(r.pause):
+			case <-r.ctx.Done():
+			}
+		}
+		if r.ctx.Err() != nil {
+			m.finish(lc, r, ROLLOUT_ABORTED, "aborted by request")
+			return
+		}
+		m.mu.Lock()
+		r.Batch = batch
+		devices := make([]*RolloutDevice, 0)
+		for _, d := range r.Devices {
+			if d.Batch == batch {
+				devices = append(devices, d)
+			}
+		}
+		m.mu.Unlock()
+
+		log.Infof("rollout batch %d/%d, %d devices", batch+1, r.Batches, len(devices))
+		wg := sync.WaitGroup{}
+		for _, d := range devices {
+			wg.Add(1)
+			go func(d *RolloutDevice) {
+				defer wg.Done()
+				m.upgrade(lc, r, d)
+			}(d)
+		}
+		wg.Wait()
+
+		if rate := m.failureRate(r); rate > *r.FailureThreshold {
+			m.finish(lc, r, ROLLOUT_HALTED, fmt.Sprintf("failure rate %.0f%% exceeds %.0f%%", rate*100, *r.FailureThreshold*100))
+			return
+		}
+	}
+	// checksum pinned in manifest is for the old version, SetVersion clears it
+	manifest.SetVersion("atx-agent", r.Version)
+	m.finish(lc, r, ROLLOUT_SUCCEEDED, "")
+}
+
+func (m *RolloutManager) failureRate(r *Rollout) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	failed, finished := 0, 0
+	for _, d := range r.Devices {
+		switch d.Status {
+		case ROLLOUT_FAILED:
+			failed++
+			finished++
+		case ROLLOUT_UPGRADED:
+			finished++
+		}
+	}
+	if finished == 0 {
+		return 0
+	}
+	return float64(failed) / float64(finished)
+}
+
+func (m *RolloutManager) setDevice(d *RolloutDevice, fn func(d *RolloutDevice)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fn(d)
+}
+
+// upgrade run in device queue, so it never runs together with init or health check of the same device
+func (m *RolloutManager) upgrade(lc *Lifecycle, r *Rollout, d *RolloutDevice) {
+	m.setDevice(d, func(d *RolloutDevice) { d.Status = ROLLOUT_UPGRADING })
+	var from string
+	var err error
+	ran := lc.workers.Do(d.Serial, func(ctx context.Context) {
+		device := adb.Device(goadb.DeviceWithSerial(d.Serial))
+		pd, er := newProvisionDevice(ctx, device, lc.ServerAddr)
+		if er != nil {
+			err = er
+			return
+		}
+		var backedUp bool
+		from, backedUp, err = pd.Keeper.upgradeAgent(r.Version)
+		if err != nil && backedUp {
+			log.Warnf("%s upgrade atx-agent %s: %v, roll back to %s", d.Serial, r.Version, err, from)
+			if er := pd.Keeper.rollbackAgent(); er != nil {
+				err = fmt.Errorf("%v, rollback: %v", err, er)
+			}
+		} else if err != nil {
+			// the atx-agent is not changed, and the backup left by an earlier upgrade may be another version
+			log.Warnf("%s upgrade atx-agent %s: %v, not changed", d.Serial, r.Version, err)
+		}
+	})
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d.From = from
+	switch {
+	case !ran:
+		d.Status = ROLLOUT_SKIPPED
+		d.Error = "device offline"
+	case err != nil:
+		d.Status = ROLLOUT_FAILED
+		d.Error = err.Error()
+	default:
+		d.Status = ROLLOUT_UPGRADED
+		m.upgraded[d.Serial] = r.Version
+	}
+}
+
+// finish roll back upgraded devices if rollout not succeeded
+func (m *RolloutManager) finish(lc *Lifecycle, r *Rollout, state string, reason string) {
+	m.mu.Lock()
+	upgraded := make([]*RolloutDevice, 0)
+	for _, d := range r.Devices {
+		if d.Status == ROLLOUT_UPGRADED {
+			upgraded = append(upgraded, d)
+		}
+		delete(m.upgraded, d.Serial)
+	}
+	m.mu.Unlock()
+
+	if state != ROLLOUT_SUCCEEDED {
+		log.Warnf("rollout atx-agent %s %s: %s, roll back %d devices", r.Version, state, reason, len(upgraded))
+		for _, d := range upgraded {
+			var err error
+			lc.workers.Do(d.Serial, func(ctx context.Context) {
+				device := adb.Device(goadb.DeviceWithSerial(d.Serial))
+				pd, er := newProvisionDevice(ctx, device, lc.ServerAddr)
+				if er != nil {
+					err = er
+					return
+				}
+				err = pd.Keeper.rollbackAgent()
+			})
+			m.setDevice(d, func(d *RolloutDevice) {
+				d.Status = ROLLOUT_ROLLED_BACK
+				if err != nil {
+					d.Error = "rollback: " + err.Error()
+				}
+			})
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	r.State = state
+	r.Error = reason
+	r.FinishedAt = &now
+	log.Infof("rollout atx-agent %s %s", r.Version, state)
+}
+
+// upgradeAgent keep the current atx-agent as backup, install version and check it works
+// backedUp is true if the backup is made, only then rollbackAgent can be used
+func (k *ATXKeeper) upgradeAgent(version string) (previous string, backedUp bool, err error) {
+	output, _ := runCommand(k.device, PATHENV, "atx-agent", "version")
+	previous = strings.TrimSpace(output)
+	backup := k.Agent.DevicePath + agentBackupSuffix
+	output, _ = runCommand(k.device, "sh", "-c",
+		fmt.Sprintf("cat %s > %s && chmod 755 %s && echo ok", k.Agent.DevicePath, backup, backup))
+	if strings.TrimSpace(output) != "ok" {
+		return previous, false, errors.New("backup atx-agent: " + strings.TrimSpace(output))
+	}
+	k.Agent.Version = version
+	k.Agent.Checksum = ""
+	k.Agent.Constraint = ""
+	if err = k.installAgent(); err != nil {
+		return previous, true, err
+	}
+	return previous, true, k.checkAgent(version)
+}
+
+// checkAgent wait until atx-agent /info responding, and check its version
+func (k *ATXKeeper) checkAgent(version string) error {
+	port, release, err := forwardAgent(k.device)
+	if err != nil {
+		return errors.Wrap(err, "forward 7912")
+	}
+	defer release()
+	deadline := time.Now().Add(agentCheckTimeout)
+	for !agentAlive(port) {
+		if time.Now().After(deadline) {
+			return errors.New("atx-agent /info not responding")
+		}
+		time.Sleep(time.Second)
+	}
+	output, _ := runCommand(k.device, PATHENV, "atx-agent", "version")
+	if current := strings.TrimSpace(output); current != version {
+		return fmt.Errorf("atx-agent version expect %s, got %s", version, current)
+	}
+	return nil
+}
+
+// rollbackAgent restore the atx-agent kept by upgradeAgent, and restart it
+func (k *ATXKeeper) rollbackAgent() error {
+	backup := k.Agent.DevicePath + agentBackupSuffix
+	output, _ := runCommand(k.device, "sh", "-c",
+		fmt.Sprintf("cat %s > %s && echo ok", backup, k.Agent.DevicePath+partialFileSuffix))
+	if strings.TrimSpace(output) != "ok" {
+		return errors.New("restore atx-agent: " + strings.TrimSpace(output))
+	}
+	// use mv to prevent "text busy" error
+	if _, err := runCommand(k.device, "mv", k.Agent.DevicePath+partialFileSuffix, k.Agent.DevicePath); err != nil {
+		return errors.Wrap(err, "restore atx-agent")
+	}
+	runCommand(k.device, "chmod", "755", k.Agent.DevicePath)
+	return k.restartAgent()
+}
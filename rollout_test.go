@@ -0,0 +1,51 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitBatches(t *testing.T) {
+	tests := []struct {
+		n, canaryPercent, batchSize int
+		batches                     []int
+		count                       int
+	}{
+		{1, 10, 5, []int{0}, 1},
+		{3, 10, 2, []int{0, 1, 1}, 2},
+		{12, 10, 5, []int{0, 0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 2}, 3},
+		{4, 100, 5, []int{0, 0, 0, 0}, 1},
+	}
+	for _, tt := range tests {
+		batches, count := splitBatches(tt.n, tt.canaryPercent, tt.batchSize)
+		if !reflect.DeepEqual(batches, tt.batches) || count != tt.count {
+			t.Errorf("splitBatches(%d, %d, %d) expect %v %d, got %v %d",
+				tt.n, tt.canaryPercent, tt.batchSize, tt.batches, tt.count, batches, count)
+		}
+	}
+}
+
+func TestRolloutConfigDefaults(t *testing.T) {
+	cfg := RolloutConfig{Version: "0.5.1"}
+	if _, err := cfg.setDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CanaryPercent != 10 || cfg.BatchSize != 5 || cfg.Pause != "1m" || cfg.FailureThreshold == nil || *cfg.FailureThreshold != 0.2 {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+	zero, two := 0.0, 2.0
+	cfg = RolloutConfig{Version: "0.5.1", FailureThreshold: &zero}
+	if _, err := cfg.setDefaults(); err != nil || *cfg.FailureThreshold != 0 {
+		t.Errorf("failureThreshold 0 should be kept, got %v %v", *cfg.FailureThreshold, err)
+	}
+	for _, cfg := range []RolloutConfig{
+		{},
+		{Version: "0.5.1", CanaryPercent: 120},
+		{Version: "0.5.1", Pause: "soon"},
+		{Version: "0.5.1", FailureThreshold: &two},
+	} {
+		if _, err := cfg.setDefaults(); err == nil {
+			t.Errorf("expect error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+// Transcript entry types
+const (
+	TRANSCRIPT_START   = "start"
+	TRANSCRIPT_STEP    = "step"
+	TRANSCRIPT_COMMAND = "command"
+	TRANSCRIPT_FINISH  = "finish"
+)
+
+// output longer than this is truncated
+const maxTranscriptOutput = 4096
+
+var stateDir string
+
+// TranscriptEntry is one line of a transcript file
+type TranscriptEntry struct {
+	Time     time.Time     `json:"time"`
+	Type     string        `json:"type"`
+	Step     string        `json:"step,omitempty"`
+	Status   string        `json:"status,omitempty"`
+	Command  string        `json:"command,omitempty"`
+	Output   string        `json:"output,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+	Attempt  int           `json:"attempt,omitempty"`
+}
+
+// TranscriptSummary describe one provision run
+type TranscriptSummary struct {
+	ID        string        `json:"id"`
+	StartedAt time.Time     `json:"startedAt"`
+	Duration  time.Duration `json:"duration"`
+	Finished  bool          `json:"finished"` // false if u2init exited while provisioning
+	Error     string        `json:"error,omitempty"`
+	Steps     int           `json:"steps"`
+	Commands  int           `json:"commands"`
+}
+
+type transcript struct {
+	id      string
+	started time.Time
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+}
+
+func (t *transcript) write(e TranscriptEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(e.Output) > maxTranscriptOutput {
+		e.Output = e.Output[:maxTranscriptOutput] + "...(truncated)"
+	}
+	if err := t.enc.Encode(e); err != nil {
+		log.Warnf("write transcript %s: %v", t.f.Name(), err)
+	}
+}
+
+// TranscriptStore record every provision run of devices into $stateDir/transcripts/$serial/$id.jsonl
+// Only the latest Keep runs not older than MaxAge are kept
+type TranscriptStore struct {
+	Keep   int
+	MaxAge time.Duration
+
+	mu     sync.Mutex
+	active map[string]*transcript
+}
+
+var transcripts = &TranscriptStore{
+	Keep:   20,
+	MaxAge: 7 * 24 * time.Hour,
+	active: make(map[string]*transcript),
+}
+
+// runCommand run shell command in device, and record it in transcript of the device
+func runCommand(device *goadb.Device, cmd string, args ...string) (string, error) {
+	return recordCommand(device, cmd, args, func(args []string) (string, error) {
+		return device.RunCommand(cmd, args...)
+	})
+}
+
+// runTimeoutCommand is same as runCommand, but fails if command not finished in timeout
+func runTimeoutCommand(device *goadb.Device, timeout time.Duration, cmd string, args ...string) (string, error) {
+	return recordCommand(device, cmd, args, func(args []string) (string, error) {
+		return device.RunTimeoutCommand(timeout, cmd, args...)
+	})
+}
+
+// recordCommand pass a copy of args to run, since go-adb quotes args in place
+func recordCommand(device *goadb.Device, cmd string, args []string, run func(args []string) (string, error)) (output string, err error) {
+	start := time.Now()
+	output, err = run(append([]string{}, args...))
+	e := TranscriptEntry{
+		Type:     TRANSCRIPT_COMMAND,
+		Command:  commandLine(cmd, args),
+		Output:   output,
+		Duration: time.Since(start),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	transcripts.Record(deviceSerial(device), e)
+	return
+}
+
+// commandLine is the shell command sent by go-adb, args contain spaces are quoted
+func commandLine(cmd string, args []string) string {
+	parts := []string{cmd}
+	for _, arg := range args {
+		if strings.ContainsAny(arg, " \t\v") {
+			arg = `"` + arg + `"`
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// deviceSerial return serial of device created by goadb.DeviceWithSerial, empty for others
+func deviceSerial(device *goadb.Device) string {
+	s := device.String() // DeviceSerial[${SERIAL}]
+	if !strings.HasPrefix(s, "DeviceSerial[") || !strings.HasSuffix(s, "]") {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(s, "DeviceSerial["), "]")
+}
+
+func (s *TranscriptStore) dir(serial string) string {
+	return filepath.Join(stateDir, "transcripts", serial)
+}
+
+// Start begin a new transcript of device, the previous one not finished is closed
+func (s *TranscriptStore) Start(serial string, attempt int) {
+	if stateDir == "" {
+		return
+	}
+	dir := s.dir(serial)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Warnf("create transcript dir: %v", err)
+		return
+	}
+	now := time.Now()
+	id := now.Format("20060102-150405.000")
+	f, err := os.Create(filepath.Join(dir, id+".jsonl"))
+	if err != nil {
+		log.Warnf("create transcript: %v", err)
+		return
+	}
+	t := &transcript{id: id, started: now, f: f, enc: json.NewEncoder(f)}
+	s.mu.Lock()
+	prev := s.active[serial]
+	s.active[serial] = t
+	s.mu.Unlock()
+	if prev != nil {
+		prev.f.Close()
+	}
+	t.write(TranscriptEntry{Time: now, Type: TRANSCRIPT_START, Attempt: attempt})
+}
+
+// Record add entry into the running transcript of device, nothing happens if device is not provisioning
+func (s *TranscriptStore) Record(serial string, e TranscriptEntry) {
+	s.mu.Lock()
+	t := s.active[serial]
+	s.mu.Unlock()
+	if t != nil {
+		t.write(e)
+	}
+}
+
+// Finish close the transcript, and remove old ones
+func (s *TranscriptStore) Finish(serial string, err error) {
+	s.mu.Lock()
+	t := s.active[serial]
+	delete(s.active, serial)
+	s.mu.Unlock()
+	if t == nil {
+		return
+	}
+	e := TranscriptEntry{Type: TRANSCRIPT_FINISH, Duration: time.Since(t.started)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	t.write(e)
+	t.f.Close()
+	s.prune(serial)
+}
+
+func (s *TranscriptStore) ids(serial string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.dir(serial))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids := make([]string, 0, len(files))
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".jsonl") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".jsonl"))
+		}
+	}
+	sort.Strings(ids) // ids are times, so sorted from old to new
+	return ids, nil
+}
+
+func (s *TranscriptStore) prune(serial string) {
+	ids, err := s.ids(serial)
+	if err != nil {
+		log.Warnf("list transcripts: %v", err)
+		return
+	}
+	for i, id := range ids {
+		tooMany := s.Keep > 0 && len(ids)-i > s.Keep
+		tooOld := false
+		if started, err := time.ParseInLocation("20060102-150405.000", id, time.Local); err == nil {
+			tooOld = s.MaxAge > 0 && time.Since(started) > s.MaxAge
+		}
+		if tooMany || tooOld {
+			os.Remove(filepath.Join(s.dir(serial), id+".jsonl"))
+		}
+	}
+}
+
+// Get return all entries of a transcript
+func (s *TranscriptStore) Get(serial string, id string) ([]TranscriptEntry, error) {
+	if filepath.Base(id) != id || id == "" {
+		return nil, fmt.Errorf("invalid transcript id: %s", id)
+	}
+	f, err := os.Open(filepath.Join(s.dir(serial), id+".jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := make([]TranscriptEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e TranscriptEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line may be partial if u2init was killed
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, errors.Wrap(scanner.Err(), "read transcript "+id)
+}
+
+// History return summaries of all transcripts of device, the latest first
+func (s *TranscriptStore) History(serial string) ([]TranscriptSummary, error) {
+	ids, err := s.ids(serial)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]TranscriptSummary, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		entries, err := s.Get(serial, ids[i])
+		if err != nil {
+			log.Warnf("read transcript %s: %v", ids[i], err)
+			continue
+		}
+		history = append(history, summarizeTranscript(ids[i], entries))
+	}
+	return history, nil
+}
+
+func summarizeTranscript(id string, entries []TranscriptEntry) TranscriptSummary {
+	summary := TranscriptSummary{ID: id}
+	for _, e := range entries {
+		switch e.Type {
+		case TRANSCRIPT_START:
+			summary.StartedAt = e.Time
+		case TRANSCRIPT_STEP:
+			summary.Steps++
+		case TRANSCRIPT_COMMAND:
+			summary.Commands++
+		case TRANSCRIPT_FINISH:
+			summary.Finished = true
+			summary.Duration = e.Duration
+			summary.Error = e.Error
+		}
+	}
+	return summary
+}
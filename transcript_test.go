@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	goadb "github.com/yosemite-open/go-adb"
+)
+
+func TestTranscriptStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "u2init-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { stateDir = d }(stateDir)
+	stateDir = dir
+
+	s := &TranscriptStore{Keep: 2, active: make(map[string]*transcript)}
+	for i := 0; i < 3; i++ {
+		s.Start("abc", i+1)
+		s.Record("abc", TranscriptEntry{Type: TRANSCRIPT_STEP, Step: "atx-agent", Status: STEP_SUCCESS})
+		s.Record("abc", TranscriptEntry{Type: TRANSCRIPT_COMMAND, Command: "pm install -r -t /sdcard/tmp/a.apk", Output: "Success"})
+		s.Record("other", TranscriptEntry{Type: TRANSCRIPT_COMMAND, Command: "ls"})
+		s.Finish("abc", errors.New("uiautomator: apk-install"))
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	history, err := s.History("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expect 2 transcripts kept, got %d", len(history))
+	}
+	h := history[0]
+	if !h.Finished || h.Steps != 1 || h.Commands != 1 || h.Error != "uiautomator: apk-install" {
+		t.Errorf("unexpected summary %+v", h)
+	}
+	if !history[0].StartedAt.After(history[1].StartedAt) {
+		t.Errorf("expect the latest first")
+	}
+
+	entries, err := s.Get("abc", h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[0].Type != TRANSCRIPT_START || entries[0].Attempt != 3 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	if _, err := s.Get("abc", "../abc"); err == nil {
+		t.Errorf("expect error for invalid id")
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	args := []string{"-c", "settings put global x 0"}
+	if got, expect := commandLine("sh", args), `sh -c "settings put global x 0"`; got != expect {
+		t.Errorf("expect %s, got %s", expect, got)
+	}
+	if args[1] != "settings put global x 0" {
+		t.Errorf("args should not be changed, got %q", args[1])
+	}
+	if got := deviceSerial((&goadb.Adb{}).Device(goadb.DeviceWithSerial("3ffecdf"))); got != "3ffecdf" {
+		t.Errorf("expect serial 3ffecdf, got %q", got)
+	}
+	if got := deviceSerial((&goadb.Adb{}).Device(goadb.AnyDevice())); got != "" {
+		t.Errorf("expect empty serial, got %q", got)
+	}
+}
@@ -1,15 +1,19 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	goadb "github.com/yosemite-open/go-adb"
+	"github.com/yosemite-open/go-adb/wire"
 )
 
 // FormatString replace ${KEY} to value
@@ -20,6 +24,28 @@ func FormatString(s string, values map[string]string) string {
 	return s
 }
 
+// KeyedMutex is a group of mutex, one for each key
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// Lock key and return the unlock function
+func (km *KeyedMutex) Lock(key string) (unlock func()) {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := km.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		km.locks[key] = l
+	}
+	km.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
 var _idLocker sync.Mutex
 var _id int
 
@@ -36,10 +62,20 @@ func HashStr(str string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+const partialFileSuffix = ".tmp-magic1231x"
+
 // write with retry
 func writeFileToDevice(device *goadb.Device, src, dst string, mode os.FileMode) error {
+	return writeFileToDeviceContext(context.Background(), device, src, dst, mode)
+}
+
+// writeFileToDeviceContext stop retry when ctx is done, a push in progress is aborted
+func writeFileToDeviceContext(ctx context.Context, device *goadb.Device, src, dst string, mode os.FileMode) error {
 	for i := 0; i < 3; i++ {
-		if err := unsafeWriteFileToDevice(device, src, dst, mode); err == nil {
+		if err := ctx.Err(); err != nil {
+			return errors.Wrap(err, "copy file to device")
+		}
+		if err := unsafeWriteFileToDevice(ctx, device, src, dst, mode); err == nil {
 			return nil
 		}
 		if i != 2 {
@@ -49,19 +85,136 @@ func writeFileToDevice(device *goadb.Device, src, dst string, mode os.FileMode)
 	return fmt.Errorf("copy file to device failed: %s -> %s", src, dst)
 }
 
-func unsafeWriteFileToDevice(device *goadb.Device, src, dst string, mode os.FileMode) error {
+func unsafeWriteFileToDevice(ctx context.Context, device *goadb.Device, src, dst string, mode os.FileMode) error {
 	f, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	dstTemp := dst + ".tmp-magic1231x"
-	_, err = device.WriteToFile(dstTemp, f, mode)
+	dstTemp := dst + partialFileSuffix
+	start := time.Now()
+	written, err := pushFile(ctx, device, f, dstTemp, mode)
+	metricPushBytes.Add(float64(written))
+	metricPushSeconds.Add(time.Since(start).Seconds())
 	if err != nil {
-		device.RunCommand("rm", dstTemp)
+		metricPushes.Inc("failure")
+		if ctx.Err() == nil {
+			runCommand(device, "rm", dstTemp)
+		}
 		return err
 	}
+	metricPushes.Inc("success")
 	// use mv to prevent "text busy" error
-	_, err = device.RunCommand("mv", dstTemp, dst)
+	_, err = runCommand(device, "mv", dstTemp, dst)
 	return err
 }
+
+// openSync dial adb server, and switch the connection to sync mode of device
+func openSync(serial string) (*wire.Conn, error) {
+	conn, err := adb.Dial()
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range []string{"host:transport:" + serial, "sync:"} {
+		if err = wire.SendMessageString(conn, req); err == nil {
+			_, err = conn.ReadStatus(req)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// pushFile write rd into path of device with adb sync SEND, like device.WriteToFile
+// The connection is closed once ctx is done, so a push is aborted right after device unplugged
+func pushFile(ctx context.Context, device *goadb.Device, rd io.Reader, path string, mode os.FileMode) (written int64, err error) {
+	serial := deviceSerial(device)
+	if serial == "" {
+		return device.WriteToFile(path, rd, mode)
+	}
+	conn, err := openSync(serial)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = errors.Wrap(ctx.Err(), "push "+path)
+		}
+	}()
+
+	sc := conn.NewSyncConn()
+	if err = sc.SendOctetString("SEND"); err != nil {
+		return
+	}
+	if err = sc.SendBytes([]byte(fmt.Sprintf("%s,%d", path, uint32(mode.Perm())))); err != nil {
+		return
+	}
+	buf := make([]byte, wire.SyncMaxChunkSize)
+	for {
+		n, rerr := rd.Read(buf)
+		if n > 0 {
+			if err = sc.SendOctetString(wire.StatusSyncData); err != nil {
+				return
+			}
+			if err = sc.SendBytes(buf[:n]); err != nil {
+				return
+			}
+			written += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+	if err = sc.SendOctetString(wire.StatusSyncDone); err != nil {
+		return
+	}
+	if err = sc.SendTime(time.Now()); err != nil {
+		return
+	}
+	_, err = sc.ReadStatus("push " + path)
+	return
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// partialFileDirs return dirs files are pushed into, including the ones changed by quirk
+func partialFileDirs(q Quirk) []string {
+	dirs := []string{"/data/local/tmp", defaultTmpDir}
+	for _, dir := range []string{q.TmpDir, q.AgentDir} {
+		if dir != "" && !containsString(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// cleanPartialFiles remove files left by writeFileToDevice which was interrupted
+func cleanPartialFiles(device *goadb.Device, q Quirk) {
+	args := []string{"-f"}
+	for _, dir := range partialFileDirs(q) {
+		args = append(args, dir+"/*"+partialFileSuffix)
+	}
+	runCommand(device, "rm", args...)
+}
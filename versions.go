@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/franela/goreq"
+	"github.com/pkg/errors"
+	"github.com/qiniu/log"
+)
+
+// Versions is the desired component versions returned by $ATX_SERVER_URL/version
+type Versions struct {
+	AgentVersion  string `json:"atx-agent"`
+	ApkVersion    string `json:"uiautomator-apk"`
+	RecordVersion string `json:"recorder-apk"`
+}
+
+var versionsMu sync.Mutex
+var versions Versions // contains apk version and atx-agent version
+
+// VersionWatcher poll atx-server for desired versions, and apply them to manifest
+// AgentOverride comes from --agent flag, and always wins over the server
+type VersionWatcher struct {
+	URL           string
+	Interval      time.Duration
+	AgentOverride string
+	OnChange      func(v Versions)
+}
+
+func NewVersionWatcher(serverAddr string) *VersionWatcher {
+	return &VersionWatcher{
+		URL:      "http://" + serverAddr + "/version",
+		Interval: time.Minute,
+	}
+}
+
+func (w *VersionWatcher) fetch() (v Versions, err error) {
+	res, err := goreq.Request{
+		Method:  "GET",
+		Uri:     w.URL,
+		Timeout: 5 * time.Second,
+	}.Do()
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		desc, _ := res.Body.ToString()
+		err = errors.Errorf("GET %s status %d: %s", w.URL, res.StatusCode, desc)
+		return
+	}
+	err = res.Body.FromJsonTo(&v)
+	return
+}
+
+// Check fetch versions once, changed is true if desired versions changed
+func (w *VersionWatcher) Check() (v Versions, changed bool, err error) {
+	v, err = w.fetch()
+	if err != nil {
+		return
+	}
+	if w.AgentOverride != "" {
+		v.AgentVersion = w.AgentOverride
+	}
+	versionsMu.Lock()
+	old := versions
+	changed = v != versions
+	versions = v
+	versionsMu.Unlock()
+	if !changed {
+		return
+	}
+	log.Infof("desired versions from server, atx-agent: %s, uiautomator-apk: %s, recorder-apk: %s",
+		v.AgentVersion, v.ApkVersion, v.RecordVersion)
+	applyVersions(old, v)
+	return
+}
+
+// Watch check versions forever, OnChange is called when versions changed
+func (w *VersionWatcher) Watch() {
+	for {
+		v, changed, err := w.Check()
+		if err != nil {
+			log.Debugf("get versions from server: %v", err)
+		}
+		if changed && w.OnChange != nil {
+			w.OnChange(v)
+		}
+		time.Sleep(w.Interval)
+	}
+}
+
+// applyVersions set changed versions to manifest, empty means back to the version in manifest
+// Versions not changed by server are not touched, they may be set by rollout
+func applyVersions(old, v Versions) {
+	setVersion := func(name, oldVersion, version string) {
+		switch {
+		case version == oldVersion:
+		case version == "":
+			manifest.ResetVersion(name)
+		default:
+			manifest.SetVersion(name, version)
+		}
+	}
+	setVersion("atx-agent", old.AgentVersion, v.AgentVersion)
+	setVersion("app-uiautomator", old.ApkVersion, v.ApkVersion)
+	setVersion("app-uiautomator-test", old.ApkVersion, v.ApkVersion)
+	setVersion("recorder", old.RecordVersion, v.RecordVersion)
+}
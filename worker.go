@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/qiniu/log"
+)
+
+// DeviceWorkers run device tasks in background
+// Tasks of the same device run one by one in the order they were added,
+// tasks of different devices run in parallel, at most `concurrency` inits at the same time
+// Adding a task never blocks, so a slow device can not stall events of other devices
+type DeviceWorkers struct {
+	mu      sync.Mutex
+	workers map[string]*deviceWorker
+	sem     chan bool
+}
+
+type deviceWorker struct {
+	tasks   []deviceTask
+	running bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// deviceTask with a key is bound to ctx of the device, it is dropped when device went offline,
+// and not added again while the same key is waiting in queue
+type deviceTask struct {
+	key string
+	ctx context.Context
+	fn  func()
+}
+
+func NewDeviceWorkers(concurrency int) *DeviceWorkers {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &DeviceWorkers{
+		workers: make(map[string]*deviceWorker),
+		sem:     make(chan bool, concurrency),
+	}
+}
+
+// worker must be called with dw.mu locked
+func (dw *DeviceWorkers) worker(serial string) *deviceWorker {
+	w, ok := dw.workers[serial]
+	if ok {
+		return w
+	}
+	w = &deviceWorker{}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	dw.workers[serial] = w
+	return w
+}
+
+// push must be called with dw.mu locked
+func (dw *DeviceWorkers) push(serial string, w *deviceWorker, t deviceTask) {
+	if t.key != "" {
+		for _, queued := range w.tasks {
+			if queued.key == t.key && queued.ctx == t.ctx {
+				log.Debugf("%s %s already in queue", serial, t.key)
+				return
+			}
+		}
+	}
+	w.tasks = append(w.tasks, t)
+	if !w.running {
+		w.running = true
+		go dw.run(serial, w)
+	}
+}
+
+func (dw *DeviceWorkers) run(serial string, w *deviceWorker) {
+	for {
+		dw.mu.Lock()
+		if len(w.tasks) == 0 {
+			w.running = false
+			// device is gone, a new worker is created when it came online again
+			if w.ctx.Err() != nil && dw.workers[serial] == w {
+				delete(dw.workers, serial)
+			}
+			dw.mu.Unlock()
+			return
+		}
+		t := w.tasks[0]
+		w.tasks = w.tasks[1:]
+		dw.mu.Unlock()
+		t.fn()
+	}
+}
+
+// bound wrap fn to run with a slot of concurrency, skipped if ctx is done
+func (dw *DeviceWorkers) bound(ctx context.Context, fn func(ctx context.Context)) func() {
+	return func() {
+		if ctx.Err() != nil {
+			return
+		}
+		dw.sem <- true
+		defer func() { <-dw.sem }()
+		fn(ctx)
+	}
+}
+
+// Online add an init task, ctx is cancelled when device went offline
+// Nothing is added if an init is already waiting in queue
+func (dw *DeviceWorkers) Online(serial string, init func(ctx context.Context)) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	w := dw.worker(serial)
+	if w.ctx.Err() != nil {
+		// device came back after offline
+		w.ctx, w.cancel = context.WithCancel(context.Background())
+	}
+	ctx := w.ctx
+	run := dw.bound(ctx, init)
+	dw.push(serial, w, deviceTask{key: "init", ctx: ctx, fn: func() {
+		if ctx.Err() != nil {
+			log.Infof("%s init canceled before start", serial)
+			return
+		}
+		run()
+	}})
+}
+
+// Offline cancel the running init immediately, offline runs after the init returns
+// Tasks waiting for the device are dropped
+func (dw *DeviceWorkers) Offline(serial string, offline func()) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	w := dw.worker(serial)
+	w.cancel()
+	tasks := w.tasks[:0]
+	for _, t := range w.tasks {
+		if t.ctx == nil {
+			tasks = append(tasks, t)
+		}
+	}
+	w.tasks = tasks
+	dw.push(serial, w, deviceTask{fn: offline})
+}
+
+// Enqueue add a task bound to ctx of a previous init, nothing happens if device already offline
+// Tasks with the same key are merged while waiting, eg: health checks of a slow device
+func (dw *DeviceWorkers) Enqueue(serial string, ctx context.Context, key string, fn func(ctx context.Context)) {
+	if ctx.Err() != nil {
+		return
+	}
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	w, ok := dw.workers[serial]
+	if !ok {
+		return
+	}
+	dw.push(serial, w, deviceTask{key: key, ctx: ctx, fn: dw.bound(ctx, fn)})
+}
+
+// Do run fn in the device queue and wait until it returns
+// false is returned if the device is offline, or went offline before fn started
+func (dw *DeviceWorkers) Do(serial string, fn func(ctx context.Context)) bool {
+	dw.mu.Lock()
+	w, ok := dw.workers[serial]
+	if !ok || w.ctx.Err() != nil {
+		dw.mu.Unlock()
+		return false
+	}
+	ctx := w.ctx
+	done := make(chan bool, 1)
+	run := dw.bound(ctx, fn)
+	// not bound to ctx, so it is never dropped while the caller is waiting
+	dw.push(serial, w, deviceTask{fn: func() {
+		if ctx.Err() != nil {
+			done <- false
+			return
+		}
+		run()
+		done <- true
+	}})
+	dw.mu.Unlock()
+	return <-done
+}
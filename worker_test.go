@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeviceWorkersOrder(t *testing.T) {
+	dw := NewDeviceWorkers(2)
+	started := make(chan bool)
+	events := make(chan string, 4)
+	dw.Online("a", func(ctx context.Context) {
+		started <- true
+		select {
+		case <-ctx.Done():
+			events <- "canceled"
+		case <-time.After(time.Second):
+			events <- "timeout"
+		}
+	})
+	<-started
+	dw.Offline("a", func() {
+		events <- "offline"
+	})
+	if e := <-events; e != "canceled" {
+		t.Fatalf("expect init canceled, got %s", e)
+	}
+	if e := <-events; e != "offline" {
+		t.Fatalf("expect offline after init, got %s", e)
+	}
+
+	// came online again
+	done := make(chan error)
+	dw.Online("a", func(ctx context.Context) {
+		done <- ctx.Err()
+	})
+	if err := <-done; err != nil {
+		t.Fatalf("expect new context, got %v", err)
+	}
+}
+
+func TestDeviceWorkersNotBlock(t *testing.T) {
+	dw := NewDeviceWorkers(1)
+	started := make(chan bool)
+	release := make(chan bool)
+	inits := make(chan bool, 100)
+	dw.Online("a", func(ctx context.Context) {
+		close(started)
+		<-release
+		inits <- true
+	})
+	<-started
+	added := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			dw.Online("a", func(ctx context.Context) { inits <- true })
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(time.Second):
+		t.Fatal("Online should not block while device is busy")
+	}
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	if n := len(inits); n != 2 {
+		t.Errorf("waiting inits should be merged, expect 2 inits, got %d", n)
+	}
+
+	offline := make(chan bool)
+	dw.Offline("a", func() { close(offline) })
+	<-offline
+	time.Sleep(50 * time.Millisecond)
+	dw.mu.Lock()
+	n := len(dw.workers)
+	dw.mu.Unlock()
+	if n != 0 {
+		t.Errorf("worker of offline device should be removed, got %d workers", n)
+	}
+	if dw.Do("a", func(ctx context.Context) {}) {
+		t.Errorf("Do should return false for offline device")
+	}
+}